@@ -1,12 +1,160 @@
 package api
 
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"qbox.me/api/progress"
+	"qbox.me/httputil"
+	"strconv"
+)
+
+const (
+	IpFailover = "failover" // try the ips of a service in order until one connects
+	IpEach     = "each"     // run the cases once per ip, see Env.Variants
+)
+
 type Env struct {
-	Id string `json:id`
+	Id string `json:"id"`
 
-	Hosts map[string]string `json:hosts`
-	Ips   map[string]string `json:"ips`
+	Hosts    map[string]string `json:"hosts"`
+	Ips      map[string]IpList `json:"ips"`
+	IpPolicy string            `json:"ip_policy"`
 
 	Fopd      string `json:"fopd"`
 	AccessKey string `json:"access_key"`
 	SecretKey string `json:"secret_key"`
+
+	Retry *httputil.RetryPolicy `json:"retry"` // httputil.DefaultRetryPolicy if nil
+
+	// Limiter limits the bandwidth of Transport, httputil.DefaultLimiter
+	// if nil. The runner sets it to the limit of each case.
+	Limiter *httputil.Limiter `json:"-"`
+
+	// Progress is where the cases tell the progress of their long
+	// transfers, nil for nowhere. The runner sets it.
+	Progress *progress.Sink `json:"-"`
+}
+
+// IpList is the ips of a service, e.g. "http://118.26.231.133:82". It is
+// decoded from either a single string or an array of strings.
+type IpList []string
+
+func (l *IpList) UnmarshalJSON(b []byte) error {
+	var ip string
+	if err := json.Unmarshal(b, &ip); err == nil {
+		*l = IpList{ip}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+// URL returns the base url of service svc: the scheme and port of its
+// first ip, with its host name. The connection is pinned to the ips by
+// Transport, so both the url and the Host header keep the host name.
+func (e *Env) URL(svc string) string {
+	ips := e.Ips[svc]
+	if len(ips) == 0 {
+		return ""
+	}
+	u, err := url.Parse(ips[0])
+	if err != nil || e.Hosts[svc] == "" {
+		return ips[0]
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(e.Hosts[svc], port)
+	} else {
+		u.Host = e.Hosts[svc]
+	}
+	return u.String()
+}
+
+// URLs returns the base urls of all services, for rs.New.
+func (e *Env) URLs() map[string]string {
+	urls := make(map[string]string)
+	for svc := range e.Ips {
+		urls[svc] = e.URL(svc)
+	}
+	return urls
+}
+
+// Pins maps the "host:port" of each service url to its ips' "ip:port".
+func (e *Env) Pins() map[string][]string {
+	pins := make(map[string][]string)
+	for svc, ips := range e.Ips {
+		from, err := hostPort(e.URL(svc))
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if to, err := hostPort(ip); err == nil && to != from {
+				pins[from] = append(pins[from], to)
+			}
+		}
+	}
+	return pins
+}
+
+// Transport returns a transport dialing the pinned ips of e, failing over
+// to the next ip of a service when one can't be connected, and limited by
+// e.Limiter.
+func (e *Env) Transport() http.RoundTripper {
+	l := e.Limiter
+	if l == nil {
+		l = httputil.DefaultLimiter
+	}
+	return httputil.NewLimitTransport(httputil.NewPinTransport(e.Pins()), l)
+}
+
+// Retrying wraps t, usually a Recorder over Transport, to retry the
+// failed requests as configured by e.Retry.
+func (e *Env) Retrying(t http.RoundTripper) http.RoundTripper {
+	return httputil.NewRetry(t, e.Retry)
+}
+
+// Variants splits e for the IpEach policy: the i-th variant pins every
+// service to its i-th ip (or its last one if it has fewer). Other policies
+// return e alone.
+func (e *Env) Variants() (envs []Env) {
+	n := 1
+	if e.IpPolicy == IpEach {
+		for _, ips := range e.Ips {
+			if len(ips) > n {
+				n = len(ips)
+			}
+		}
+	}
+	if n == 1 {
+		return []Env{*e}
+	}
+	for i := 0; i < n; i++ {
+		env := *e
+		env.Id = e.Id + "@" + strconv.Itoa(i)
+		env.Ips = make(map[string]IpList)
+		for svc, ips := range e.Ips {
+			if i < len(ips) {
+				env.Ips[svc] = IpList{ips[i]}
+			} else if len(ips) > 0 {
+				env.Ips[svc] = IpList{ips[len(ips)-1]}
+			}
+		}
+		envs = append(envs, env)
+	}
+	return
+}
+
+func hostPort(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
 }
@@ -0,0 +1,302 @@
+// Package progress reports the progress of the long transfers of the
+// cases, e.g. a 2GiB upload: as a live line on a terminal, as periodic log
+// lines, and as vars to publish with expvar. The runner makes the Sink and
+// hands it to the cases in api.Env.Progress.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"qbox.me/log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------
+
+// Sink tracks the transfers started in it. A nil *Sink tracks nothing, and
+// starts nil *Transfers, on which all methods do nothing.
+type Sink struct {
+	tty      io.Writer     // where the live line is drawn, nil for none
+	interval time.Duration // between log lines, 0 for none
+
+	inFlight int32
+
+	mu        sync.Mutex
+	transfers []*Transfer
+	lastLog   time.Time
+	drawn     bool // a live line is on tty
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// ttyRefresh is how often the live line is drawn.
+const ttyRefresh = 500 * time.Millisecond
+
+// NewSink returns a sink drawing a live line on tty if not nil, and logging
+// the transfers in flight every interval if > 0. It runs until Close.
+func NewSink(tty io.Writer, interval time.Duration) *Sink {
+
+	s := &Sink{tty: tty, interval: interval, lastLog: time.Now(), stop: make(chan struct{})}
+	tick := interval
+	if tty != nil {
+		tick = ttyRefresh
+	}
+	if tick > 0 {
+		go s.run(tick)
+	}
+	return s
+}
+
+func (s *Sink) Close() {
+	if s == nil {
+		return
+	}
+	s.closeOnce.Do(func() { close(s.stop) })
+}
+
+func (s *Sink) run(tick time.Duration) {
+
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			s.report(now)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Sink) report(now time.Time) {
+
+	stats := s.Stats()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tty != nil && len(stats) > 0 {
+		fmt.Fprint(s.tty, "\r"+joinStats(stats)+"\x1b[K")
+		s.drawn = true
+	}
+	if s.interval > 0 && now.Sub(s.lastLog) >= s.interval {
+		s.lastLog = now
+		for _, st := range stats {
+			log.Info("progress:", st)
+		}
+	}
+}
+
+// InFlight returns how many transfers are started and not done.
+func (s *Sink) InFlight() int {
+	if s == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&s.inFlight))
+}
+
+// Stats returns the stats of the transfers in flight.
+func (s *Sink) Stats() []Stat {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	transfers := append([]*Transfer(nil), s.transfers...)
+	s.mu.Unlock()
+	stats := make([]Stat, len(transfers))
+	for i, t := range transfers {
+		stats[i] = t.Stat()
+	}
+	return stats
+}
+
+// Vars is what the sink publishes with expvar.Func: the in-flight gauge
+// and the stats of the transfers in flight.
+func (s *Sink) Vars() interface{} {
+	return map[string]interface{}{
+		"in_flight": s.InFlight(),
+		"transfers": s.Stats(),
+	}
+}
+
+// Start tracks the transfer of total bytes, -1 if unknown, named name,
+// e.g. the case and its entry.
+func (s *Sink) Start(name string, total int64) *Transfer {
+	if s == nil {
+		return nil
+	}
+	t := &Transfer{sink: s, name: name, total: total, begin: time.Now(), blocks: make(map[int]int64)}
+	atomic.AddInt32(&s.inFlight, 1)
+	s.mu.Lock()
+	s.transfers = append(s.transfers, t)
+	s.mu.Unlock()
+	return t
+}
+
+func (s *Sink) done(t *Transfer) {
+
+	atomic.AddInt32(&s.inFlight, -1)
+	st := t.Stat()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t1 := range s.transfers {
+		if t1 == t {
+			s.transfers = append(s.transfers[:i], s.transfers[i+1:]...)
+			break
+		}
+	}
+	if s.drawn {
+		fmt.Fprint(s.tty, "\r"+st.String()+"\x1b[K\n")
+		s.drawn = false
+	}
+	if s.interval > 0 {
+		log.Info("progress done:", st)
+	}
+}
+
+func joinStats(stats []Stat) string {
+	strs := make([]string, len(stats))
+	for i, st := range stats {
+		strs[i] = st.String()
+	}
+	return strings.Join(strs, " | ")
+}
+
+// --------------------------------------------------------------------
+
+// Transfer is the progress of one transfer, told by its concurrent
+// workers either the bytes done so far by each block, or the bytes done
+// since the last call.
+type Transfer struct {
+	sink  *Sink
+	name  string
+	total int64
+	begin time.Time
+
+	mu     sync.Mutex
+	blocks map[int]int64
+	added  int64
+	ended  bool
+}
+
+// SetBlock tells that done bytes of the block blockIdx are done. It may be
+// less than before, e.g. when a block is put again from its start.
+func (t *Transfer) SetBlock(blockIdx int, done int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.blocks[blockIdx] = done
+	t.mu.Unlock()
+}
+
+// Add tells that n more bytes are done.
+func (t *Transfer) Add(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.added += n
+	t.mu.Unlock()
+}
+
+// Reader returns r telling t the bytes read.
+func (t *Transfer) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &reader{r, t}
+}
+
+type reader struct {
+	r io.Reader
+	t *Transfer
+}
+
+func (r *reader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.t.Add(int64(n))
+	return
+}
+
+// Done ends the transfer, done or failed.
+func (t *Transfer) Done() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	ended := t.ended
+	t.ended = true
+	t.mu.Unlock()
+	if !ended {
+		t.sink.done(t)
+	}
+}
+
+// Stat is a snapshot of a Transfer. Rate is in bytes per second since the
+// start, and ETA is 0 if unknown.
+type Stat struct {
+	Name    string        `json:"name"`
+	Done    int64         `json:"done"`
+	Total   int64         `json:"total"`
+	Rate    float64       `json:"rate"`
+	Elapsed time.Duration `json:"elapsed"`
+	ETA     time.Duration `json:"eta"`
+}
+
+func (t *Transfer) Stat() Stat {
+
+	t.mu.Lock()
+	done := t.added
+	for _, n := range t.blocks {
+		done += n
+	}
+	t.mu.Unlock()
+	st := Stat{Name: t.name, Done: done, Total: t.total, Elapsed: time.Since(t.begin)}
+	if secs := st.Elapsed.Seconds(); secs > 0 {
+		st.Rate = float64(done) / secs
+	}
+	if st.Rate > 0 && t.total > done {
+		st.ETA = time.Duration(float64(t.total-done) / st.Rate * float64(time.Second))
+	}
+	return st
+}
+
+// Percent is how much of Total is done, -1 if Total is unknown.
+func (st Stat) Percent() float64 {
+	if st.Total < 0 {
+		return -1
+	}
+	if st.Total == 0 {
+		return 100
+	}
+	return float64(st.Done) * 100 / float64(st.Total)
+}
+
+func (st Stat) String() string {
+	rate := Bytes(int64(st.Rate)) + "/s"
+	if st.Total < 0 {
+		return fmt.Sprintf("%v %v %v", st.Name, Bytes(st.Done), rate)
+	}
+	eta := "--"
+	if st.ETA > 0 {
+		eta = st.ETA.Truncate(time.Second).String()
+	}
+	return fmt.Sprintf("%v %5.1f%% of %v %v ETA %v", st.Name, st.Percent(), Bytes(st.Total), rate, eta)
+}
+
+// Bytes formats n with a binary unit, e.g. "12.3MiB".
+func Bytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for ; f >= 1024 && i < len(units)-1; i++ {
+		f /= 1024
+	}
+	return fmt.Sprintf("%.1f%ciB", f, units[i])
+}
+
+// --------------------------------------------------------------------
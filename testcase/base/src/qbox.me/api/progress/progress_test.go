@@ -0,0 +1,82 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestTransfer(t *testing.T) {
+
+	tty := new(syncBuffer)
+	s := NewSink(tty, 0)
+	defer s.Close()
+
+	tr := s.Start("up_put bucket:key", 4000)
+	if s.InFlight() != 1 {
+		t.Fatal("in flight:", s.InFlight())
+	}
+	tr.SetBlock(0, 1000)
+	tr.SetBlock(1, 500)
+	tr.SetBlock(1, 1000) // the offset of a block, not a delta
+	tr.Reader(strings.NewReader("0123456789")).Read(make([]byte, 4))
+	st := tr.Stat()
+	if st.Done != 2004 || st.Percent() != 50.1 || st.Rate <= 0 || st.ETA <= 0 {
+		t.Fatal("stat:", st)
+	}
+
+	time.Sleep(ttyRefresh + 100*time.Millisecond)
+	if out := tty.String(); !strings.Contains(out, "\rup_put bucket:key  50.1% of 3.9KiB") {
+		t.Fatalf("live line: %q", out)
+	}
+	vars := s.Vars().(map[string]interface{})
+	if vars["in_flight"] != 1 || len(vars["transfers"].([]Stat)) != 1 {
+		t.Fatal("vars:", vars)
+	}
+
+	tr.Done()
+	tr.Done()
+	if s.InFlight() != 0 || len(s.Stats()) != 0 || !strings.HasSuffix(tty.String(), "\n") {
+		t.Fatalf("after done: %v %q", s.InFlight(), tty.String())
+	}
+}
+
+func TestNilSink(t *testing.T) {
+
+	var s *Sink
+	tr := s.Start("x", 10)
+	tr.SetBlock(0, 1)
+	tr.Add(1)
+	tr.Done()
+	if s.InFlight() != 0 || s.Stats() != nil || tr != nil {
+		t.Fatal("a nil sink tracks nothing")
+	}
+	s.Close()
+}
+
+func TestBytes(t *testing.T) {
+	for n, str := range map[int64]string{0: "0B", 1023: "1023B", 1536: "1.5KiB", 2 << 30: "2.0GiB"} {
+		if Bytes(n) != str {
+			t.Fatal("Bytes:", n, Bytes(n), "expected", str)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package resume keeps the progress of resumable uploads in a JSON file,
+// so that an upload interrupted by the death of the process is resumed by
+// a later run instead of restarted from zero.
+//
+// A record is keyed by the entry URI and a fingerprint of the content, and
+// holds the ctx, offset, checksum and crc32 of each block. It is saved on
+// each chunk or block notify of the uploader, and deleted after mkfile.
+package resume
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Block struct {
+	Ctx      string `json:"ctx"`
+	Offset   int64  `json:"offset"`
+	Checksum string `json:"checksum"` // of the last chunk put, that of the block once all put
+	Crc32    uint32 `json:"crc32"`    // of the last chunk put
+}
+
+type Record struct {
+	EntryURI    string    `json:"entry"`
+	Fingerprint string    `json:"fingerprint"`
+	Size        int64     `json:"size"`
+	BlockBits   uint      `json:"block_bits"`
+	Blocks      []Block   `json:"blocks"`
+	Updated     time.Time `json:"updated"`
+}
+
+// Store is the progress file. Its methods may be called by concurrent
+// block workers.
+type Store struct {
+	path string
+	mu   sync.Mutex
+	recs map[string]*Record
+}
+
+// Open loads the progress file path, which needs not exist.
+func Open(path string) (s *Store, err error) {
+
+	s = &Store{path: path, recs: make(map[string]*Record)}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(b, &s.recs); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func key(entryURI, fingerprint string) string {
+	return entryURI + " " + fingerprint
+}
+
+// Load returns a copy of the saved progress of the upload of a content of
+// size bytes in blocks of 1<<blockBits to entryURI, nil if there is none
+// or it was saved for another size or block size.
+func (s *Store) Load(entryURI, fingerprint string, size int64, blockBits uint) *Record {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.recs[key(entryURI, fingerprint)]
+	if !ok || rec.Size != size || rec.BlockBits != blockBits {
+		return nil
+	}
+	rec1 := *rec
+	rec1.Blocks = append([]Block(nil), rec.Blocks...)
+	return &rec1
+}
+
+// NewRecord returns an empty record with the blocks of a content of size
+// bytes, to be saved with Save.
+func NewRecord(entryURI, fingerprint string, size int64, blockBits uint) *Record {
+	n := (size + 1<<blockBits - 1) >> blockBits
+	return &Record{
+		EntryURI: entryURI, Fingerprint: fingerprint, Size: size, BlockBits: blockBits,
+		Blocks: make([]Block, n),
+	}
+}
+
+// SaveBlock sets the block idx of the record of rec.EntryURI and writes
+// the progress file.
+func (s *Store) SaveBlock(rec *Record, idx int, b Block) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(rec.EntryURI, rec.Fingerprint)
+	saved, ok := s.recs[k]
+	if !ok || saved.Size != rec.Size || saved.BlockBits != rec.BlockBits {
+		saved = &Record{
+			EntryURI: rec.EntryURI, Fingerprint: rec.Fingerprint, Size: rec.Size, BlockBits: rec.BlockBits,
+			Blocks: append([]Block(nil), rec.Blocks...),
+		}
+		s.recs[k] = saved
+	}
+	saved.Blocks[idx] = b
+	saved.Updated = time.Now()
+	return s.write()
+}
+
+// Delete drops the record, once the upload is done.
+func (s *Store) Delete(entryURI, fingerprint string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(entryURI, fingerprint)
+	if _, ok := s.recs[k]; !ok {
+		return nil
+	}
+	delete(s.recs, k)
+	return s.write()
+}
+
+// write replaces the progress file, through a rename so that a crash
+// never leaves half a file.
+func (s *Store) write() error {
+
+	b, err := json.MarshalIndent(s.recs, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// --------------------------------------------------------------------
+
+const sampleSize = 64 << 10
+
+// Fingerprint identifies a content of size bytes by its size and the sha1
+// of its first, middle and last 64K: cheap for a large file, and enough
+// to tell the data files of the cases apart.
+func Fingerprint(r io.ReaderAt, size int64) (string, error) {
+
+	h := sha1.New()
+	io.WriteString(h, strconv.FormatInt(size, 10))
+	for _, off := range []int64{0, size/2 - sampleSize/2, size - sampleSize} {
+		if off < 0 {
+			off = 0
+		}
+		if _, err := io.Copy(h, io.NewSectionReader(r, off, sampleSize)); err != nil {
+			return "", err
+		}
+	}
+	return base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,84 @@
+package resume
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "progress.json")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal("Open of a missing file:", err)
+	}
+	if s.Load("bucket:key", "fp", 10<<20, 22) != nil {
+		t.Fatal("Load from an empty store")
+	}
+	rec := NewRecord("bucket:key", "fp", 10<<20, 22)
+	if len(rec.Blocks) != 3 {
+		t.Fatal("NewRecord blocks:", len(rec.Blocks))
+	}
+	b1 := Block{Ctx: "ctx1", Offset: 1 << 20, Crc32: 7}
+	b2 := Block{Ctx: "ctx2", Offset: 2 << 20, Checksum: "sum2", Crc32: 8}
+	if err = s.SaveBlock(rec, 1, b1); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SaveBlock(rec, 2, b2); err != nil {
+		t.Fatal(err)
+	}
+
+	// a later run
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.Load("bucket:key", "fp", 10<<20, 22)
+	if got == nil || got.Blocks[0] != (Block{}) || got.Blocks[1] != b1 || got.Blocks[2] != b2 {
+		t.Fatal("Load:", got)
+	}
+	if s.Load("bucket:key", "other", 10<<20, 22) != nil ||
+		s.Load("bucket:key", "fp", 11<<20, 22) != nil ||
+		s.Load("bucket:key", "fp", 10<<20, 20) != nil {
+		t.Fatal("Load of another content or block size")
+	}
+	got.Blocks[1].Ctx = "changed"
+	if s.Load("bucket:key", "fp", 10<<20, 22).Blocks[1] != b1 {
+		t.Fatal("Load should return a copy")
+	}
+
+	if err = s.Delete("bucket:key", "fp"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = Open(path); err != nil || s.Load("bucket:key", "fp", 10<<20, 22) != nil {
+		t.Fatal("Delete:", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	fp1, err := Fingerprint(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp2, _ := Fingerprint(bytes.NewReader(data), int64(len(data))); fp2 != fp1 {
+		t.Fatal("Fingerprint not deterministic")
+	}
+	data[len(data)-1] = 'x'
+	if fp2, _ := Fingerprint(bytes.NewReader(data), int64(len(data))); fp2 == fp1 {
+		t.Fatal("Fingerprint ignores the tail")
+	}
+	if _, err = Fingerprint(bytes.NewReader(data[:10]), 10); err != nil {
+		t.Fatal("Fingerprint of a small content:", err)
+	}
+}
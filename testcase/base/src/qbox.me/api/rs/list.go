@@ -0,0 +1,91 @@
+package rs
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// ListItem is an entry returned by the rsf list api.
+type ListItem struct {
+	Key string `json:"key"`
+	Entry
+}
+
+type ListRet struct {
+	Marker string     `json:"marker"` // "" when there are no more items
+	Items  []ListItem `json:"items"`
+}
+
+// List returns at most limit entries of bucket whose key begins with prefix,
+// in key order, starting after marker ("" for the first page). The request
+// is sent to the "rsf" service.
+func (s *Service) List(bucket, prefix, marker string, limit int) (ret ListRet, code int, err error) {
+	params := url.Values{"bucket": {bucket}}
+	if prefix != "" {
+		params.Set("prefix", prefix)
+	}
+	if marker != "" {
+		params.Set("marker", marker)
+	}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	code, err = s.Conn.CallEx(&ret, s.ip["rsf"]+"/list?"+params.Encode(), s.host["rsf"])
+	return
+}
+
+// Lister walks every page of a listing:
+//
+//	l := s.NewLister(bucket, prefix, 100)
+//	for l.Next() {
+//		item := l.Item()
+//	}
+//	if l.Err() != nil { ... }
+type Lister struct {
+	s              *Service
+	bucket, prefix string
+	limit          int
+	marker         string
+	items          []ListItem
+	item           ListItem
+	pages          int
+	err            error
+	done           bool
+}
+
+func (s *Service) NewLister(bucket, prefix string, limit int) *Lister {
+	return &Lister{s: s, bucket: bucket, prefix: prefix, limit: limit}
+}
+
+// Next advances to the next item, fetching the next page if needed. It
+// returns false at the end of the listing or on error.
+func (l *Lister) Next() bool {
+	for len(l.items) == 0 {
+		if l.done || l.err != nil {
+			return false
+		}
+		ret, _, err := l.s.List(l.bucket, l.prefix, l.marker, l.limit)
+		if err != nil {
+			l.err = err
+			return false
+		}
+		l.pages++
+		l.done = ret.Marker == "" || ret.Marker == l.marker
+		l.items, l.marker = ret.Items, ret.Marker
+	}
+	l.item, l.items = l.items[0], l.items[1:]
+	return true
+}
+
+func (l *Lister) Item() ListItem {
+	return l.item
+}
+
+// Pages is the number of pages fetched so far.
+func (l *Lister) Pages() int {
+	return l.pages
+}
+
+func (l *Lister) Err() error {
+	return l.err
+}
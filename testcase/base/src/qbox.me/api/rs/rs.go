@@ -1,13 +1,15 @@
 package rs
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 	"qbox.us/rpc"
+	"qbox.me/errcode"
 	"qbox.me/httputil"
 )
 
@@ -16,10 +18,14 @@ type Service struct {
 	Conn     *httputil.Client
 }
 
+// ip is the base url of each service, see api.Env.URLs. The requests are
+// sent to ip with the Host header host, so with api.Env.Transport under t
+// they are pinned to the env ips, and limited as the env is. If t is nil,
+// they are limited by httputil.DefaultLimiter.
 func New(host, ip map[string]string, t http.RoundTripper) (s *Service, err error) {
 
 	if t == nil {
-		t = http.DefaultTransport
+		t = httputil.NewLimitTransport(http.DefaultTransport, httputil.DefaultLimiter)
 	}
 	client := &http.Client{Transport: t}
 	s = &Service{host, ip, &httputil.Client{client}}
@@ -75,11 +81,6 @@ func (s *Service) Get(entryURI, base, attName string, expires int) (data GetRet,
 	return
 }
 
-// 
-func replaceHostWithIP(url, host, ip string) string {
-	return strings.Replace(url, host, ip, 1)
-}
-
 // Fetch  downloads a file specified the url and then stores it as the fname
 // on the disk.
 func (s *Service) Fetch(url, saveAs string) error {
@@ -89,8 +90,6 @@ func (s *Service) Fetch(url, saveAs string) error {
 		return err
 	}
 
-	ip := string([]byte(s.ip["io"][7:]))
-	url = replaceHostWithIP(url, s.host["io"], ip)
 	reader, err := s.Conn.DownloadEx(url, s.host["io"])
 	if err != nil {
 		return err
@@ -132,7 +131,11 @@ func (s *Service) Unpublish(domain string) (code int, err error) {
 	return s.Conn.CallEx(nil, s.ip["rs"]+"/unpublish/"+rpc.EncodeURI(domain), s.host["rs"])
 }
 
-// -------------------Batcher to do -----------------------------------
+// -------------------Batcher -----------------------------------------
+
+// DefaultBatchLimit is the maximum number of ops sent in one batch request
+// when Batcher.Limit is 0.
+const DefaultBatchLimit = 1000
 
 type BatchRet struct {
 	Data  interface{} `json:"data"`
@@ -140,10 +143,23 @@ type BatchRet struct {
 	Error string      `json:"error"`
 }
 
+// BatchItem is the result of one op of a batch. Err is nil if the op
+// succeeded, else a *httputil.Error wrapping the errcode of the op, e.g.
+// errors.Is(item.Err, errcode.ENoSuchEntry), or the error of the whole
+// request which carried it.
+type BatchItem struct {
+	Op  string
+	Ret BatchRet
+	Err error
+}
+
 type Batcher struct {
 	s1  *Service
 	op  []string
 	ret []BatchRet
+
+	Limit       int // ops per request, DefaultBatchLimit if 0
+	Concurrency int // requests in flight, 1 if 0
 }
 
 func (s *Service) NewBatcher() *Batcher {
@@ -189,10 +205,88 @@ func (b *Batcher) Len() int {
 	return len(b.op)
 }
 
-func (b *Batcher) Do() (ret []BatchRet, code int, err error) {
+// Exec sends the queued ops, Limit per request and Concurrency requests at
+// a time, and returns one item per op in the order they were queued. err
+// is the first request which failed as a whole, if any.
+func (b *Batcher) Exec() (items []BatchItem, err error) {
+
+	limit := b.Limit
+	if limit <= 0 {
+		limit = DefaultBatchLimit
+	}
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
 	s := b.s1
-	code, err = s.Conn.CallWithForm(&b.ret, s.host["rs"]+"/batch", map[string][]string{"op": b.op})
-	ret = b.ret
+	url := s.ip["rs"] + "/batch"
+
+	items = make([]BatchItem, len(b.op))
+	errs := make([]error, (len(b.op)+limit-1)/limit)
+	sem := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < len(b.op); i += limit {
+		j := i + limit
+		if j > len(b.op) {
+			j = len(b.op)
+		}
+		wg.Add(1)
+		sem <- true
+		go func(i, j int) {
+			defer func() { <-sem; wg.Done() }()
+			ret := b.ret[i:j:j]
+			_, err := s.Conn.CallWithFormEx(&ret, url, s.host["rs"], map[string][]string{"op": b.op[i:j]})
+			if err == nil && len(ret) != j-i {
+				err = &httputil.Error{Errno: errcode.EUnexceptedResponse, Method: "POST", URL: url,
+					Err: "batch returned " + strconv.Itoa(len(ret)) + " results for " + strconv.Itoa(j-i) + " ops"}
+			}
+			errs[i/limit] = err
+			for k := i; k < j; k++ {
+				items[k] = BatchItem{Op: b.op[k], Err: err}
+				if err == nil {
+					items[k].Ret = ret[k-i]
+					items[k].Err = opError(ret[k-i], url, b.op[k])
+				}
+			}
+		}(i, j)
+	}
+	wg.Wait()
+
+	for _, err = range errs {
+		if err != nil {
+			return
+		}
+	}
+	return items, nil
+}
+
+func opError(ret BatchRet, url, op string) error {
+	if ret.Code/100 == 2 {
+		return nil
+	}
+	return &httputil.Error{Errno: errcode.Errno(ret.Code), Code: ret.Code,
+		Err: ret.Error, Method: "POST", URL: url + " op=" + op}
+}
+
+// Do is Exec returning the raw results. code is 298 if some of the ops
+// failed, as for a single batch request.
+func (b *Batcher) Do() (ret []BatchRet, code int, err error) {
+	items, err := b.Exec()
+	if err != nil {
+		code = errcode.InternalError
+		var e *httputil.Error
+		if errors.As(err, &e) {
+			code = int(e.Errno)
+		}
+		return
+	}
+	ret, code = make([]BatchRet, len(items)), 200
+	for i, item := range items {
+		ret[i] = item.Ret
+		if item.Err != nil {
+			code = errcode.PartialOK
+		}
+	}
 	return
 }
 
@@ -204,6 +298,15 @@ func (s Service) Upload(entryURI, localFile, mimeType, customMeta, callbackParam
 func (s Service) UploadEx(upToken string, localFile, entryURI string, mimeType, customMeta, callbackParam string,
 	crc int64, rotate int) (ret PutRet, code int, err error) {
 
+	code, err = s.UploadRet(&ret, upToken, localFile, entryURI, mimeType, customMeta, callbackParam, crc, rotate)
+	return
+}
+
+// UploadRet is UploadEx decoding the response in ret, e.g. what the
+// callback of the upToken answered, which the up service relays.
+func (s Service) UploadRet(ret interface{}, upToken string, localFile, entryURI string, mimeType, customMeta, callbackParam string,
+	crc int64, rotate int) (code int, err error) {
+
 	action := "/rs-put/" + rpc.EncodeURI(entryURI)
 	if mimeType == "" {
 		mimeType = "application/octet-stream"
@@ -231,6 +334,6 @@ func (s Service) UploadEx(upToken string, localFile, entryURI string, mimeType,
 		multiParams["params"] = []string{callbackParam}
 	}
 
-	code, err = s.Conn.CallWithMultipartEx(&ret, url, s.host["up"], multiParams)
+	code, err = s.Conn.CallWithMultipartEx(ret, url, s.host["up"], multiParams)
 	return
 }
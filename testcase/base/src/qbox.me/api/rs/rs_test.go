@@ -0,0 +1,183 @@
+package rs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"qbox.me/errcode"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchServer answers /batch as rs does: "bucket:k<i>" is stat'ed as a
+// file of i bytes, but for i%7 == 3 which is missing. The batches holding
+// the first ops are the slowest, so the requests end out of order.
+type batchServer struct {
+	mu       sync.Mutex
+	sizes    []int // ops per request, in the order they arrived
+	inFlight int
+	maxIn    int
+}
+
+func (b *batchServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	b.mu.Lock()
+	b.inFlight++
+	if b.inFlight > b.maxIn {
+		b.maxIn = b.inFlight
+	}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.inFlight--
+		b.mu.Unlock()
+	}()
+
+	if req.URL.Path != "/batch" || req.ParseForm() != nil {
+		w.WriteHeader(400)
+		return
+	}
+	ops := req.PostForm["op"]
+	b.mu.Lock()
+	b.sizes = append(b.sizes, len(ops))
+	b.mu.Unlock()
+
+	ret := make([]BatchRet, len(ops))
+	first := -1
+	for k, op := range ops {
+		uri, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(op, "/stat/"))
+		i, err1 := strconv.Atoi(strings.TrimPrefix(string(uri), "bucket:k"))
+		switch {
+		case err != nil || err1 != nil:
+			ret[k] = BatchRet{Code: 400, Error: "bad op " + op}
+		case i%7 == 3:
+			ret[k] = BatchRet{Code: errcode.NoSuchEntry, Error: "no such file or directory"}
+		default:
+			ret[k] = BatchRet{Code: 200, Data: map[string]interface{}{"fsize": i}}
+		}
+		if k == 0 {
+			first = i
+		}
+	}
+	time.Sleep(time.Duration(30-first) * 2 * time.Millisecond)
+
+	w.Header().Set("Content-Type", "application/json")
+	code := 200
+	for _, r := range ret {
+		if r.Code != 200 {
+			code = errcode.PartialOK
+		}
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ret)
+}
+
+func TestBatcherExec(t *testing.T) {
+
+	b := new(batchServer)
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	s, _ := New(map[string]string{"rs": "rs.test"}, map[string]string{"rs": srv.URL}, nil)
+	batcher := s.NewBatcher()
+	batcher.Limit = 4
+	batcher.Concurrency = 3
+	for i := 0; i < 25; i++ {
+		batcher.Stat("bucket:k" + strconv.Itoa(i))
+	}
+	items, err := batcher.Exec()
+	if err != nil {
+		t.Fatal("Exec:", err)
+	}
+
+	// 25 ops of 4 per request
+	if len(b.sizes) != 7 {
+		t.Fatal("requests:", b.sizes)
+	}
+	sum := 0
+	for _, n := range b.sizes {
+		if n != 4 && n != 1 {
+			t.Fatal("ops per request:", b.sizes)
+		}
+		sum += n
+	}
+	if sum != 25 {
+		t.Fatal("ops sent:", b.sizes)
+	}
+	if b.maxIn < 2 || b.maxIn > 3 {
+		t.Fatal("requests in flight:", b.maxIn)
+	}
+
+	// in the order queued, the missing ones failed alone
+	if len(items) != 25 {
+		t.Fatal("items:", len(items))
+	}
+	for i, item := range items {
+		if item.Op != "/stat/"+base64.URLEncoding.EncodeToString([]byte("bucket:k"+strconv.Itoa(i))) {
+			t.Fatal("op", i, "is", item.Op)
+		}
+		if i%7 == 3 {
+			if !errors.Is(item.Err, errcode.ENoSuchEntry) || item.Ret.Code != errcode.NoSuchEntry {
+				t.Fatal("op", i, "should be missing:", item.Ret, item.Err)
+			}
+			continue
+		}
+		if item.Err != nil {
+			t.Fatal("op", i, "failed:", item.Err)
+		}
+		if fsize := item.Ret.Data.(map[string]interface{})["fsize"]; fsize != float64(i) {
+			t.Fatal("op", i, "got the result of another:", fsize)
+		}
+	}
+
+	ret, code, err := batcher.Do()
+	if err != nil || code != errcode.PartialOK || len(ret) != 25 {
+		t.Fatal("Do:", len(ret), code, err)
+	}
+}
+
+func TestBatcherExecFailed(t *testing.T) {
+
+	// the second request answers one result short
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		mu.Lock()
+		n++
+		short := n == 2
+		mu.Unlock()
+		ret := make([]BatchRet, len(req.PostForm["op"]))
+		for i := range ret {
+			ret[i].Code = 200
+		}
+		if short {
+			ret = ret[1:]
+		}
+		json.NewEncoder(w).Encode(ret)
+	}))
+	defer srv.Close()
+
+	s, _ := New(map[string]string{"rs": "rs.test"}, map[string]string{"rs": srv.URL}, nil)
+	batcher := s.NewBatcher()
+	batcher.Limit = 2
+	for i := 0; i < 5; i++ {
+		batcher.Delete("bucket:k" + strconv.Itoa(i))
+	}
+	items, err := batcher.Exec()
+	if !errors.Is(err, errcode.EUnexceptedResponse) {
+		t.Fatal("Exec:", err)
+	}
+	for i, item := range items {
+		if failed := i == 2 || i == 3; (item.Err != nil) != failed {
+			t.Fatal("op", i, "err:", item.Err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package up
+
+import (
+	"io"
+	"qbox.me/api/resume"
+	"qbox.me/log"
+)
+
+// Saver saves the progress of a Put to a resume.Store, so that an upload
+// interrupted by the death of the process is resumed by a later run.
+type Saver struct {
+	Store     *resume.Store
+	Record    *resume.Record
+	checksums []string
+	progs     []BlockProgress
+}
+
+// Resume loads into checksums and progs the progress of the upload of f
+// to entryURI saved in store, if any, and returns the Saver whose notifies
+// to pass to Put.
+func (r Service) Resume(
+	store *resume.Store, entryURI string, f io.ReaderAt, fsize int64,
+	checksums []string, progs []BlockProgress) (s *Saver, resumed bool, err error) {
+
+	fp, err := resume.Fingerprint(f, fsize)
+	if err != nil {
+		return
+	}
+	s = &Saver{Store: store, checksums: checksums, progs: progs}
+	s.Record = store.Load(entryURI, fp, fsize, r.BlockBits)
+	if s.Record == nil || len(s.Record.Blocks) != len(progs) {
+		s.Record = resume.NewRecord(entryURI, fp, fsize, r.BlockBits)
+		return s, false, nil
+	}
+	blockSize := int64(1) << r.BlockBits
+	for i, b := range s.Record.Blocks {
+		if i == len(progs)-1 {
+			blockSize = fsize - int64(i)<<r.BlockBits
+		}
+		if b.Offset == blockSize && b.Checksum == "" {
+			b = resume.Block{} // saved without the checksum of its last chunk: put it again
+		}
+		// the last chunk of a block may be saved and not the block, if the
+		// process died in between: its checksum is that of the block
+		if b.Offset == blockSize {
+			checksums[i] = b.Checksum
+		}
+		progs[i] = BlockProgress{Ctx: b.Ctx, Offset: int(b.Offset), RestSize: int(blockSize - b.Offset),
+			Checksum: b.Checksum, Crc32: b.Crc32}
+	}
+	return s, true, nil
+}
+
+func (s *Saver) save(blockIdx int, checksum string) {
+	p := s.progs[blockIdx]
+	err := s.Store.SaveBlock(s.Record, blockIdx, resume.Block{Ctx: p.Ctx, Offset: int64(p.Offset), Checksum: checksum, Crc32: p.Crc32})
+	if err != nil {
+		log.Warn("up: save progress failed:", s.Record.EntryURI, err)
+	}
+}
+
+// BlockNotify returns the blockNotify for Put, calling next if not nil.
+func (s *Saver) BlockNotify(next func(blockIdx int, checksum string)) func(int, string) {
+	return func(blockIdx int, checksum string) {
+		s.save(blockIdx, checksum)
+		if next != nil {
+			next(blockIdx, checksum)
+		}
+	}
+}
+
+// ChunkNotify returns the chunkNotify for Put, calling next if not nil.
+func (s *Saver) ChunkNotify(next func(blockIdx int, prog *BlockProgress)) func(int, *BlockProgress) {
+	return func(blockIdx int, prog *BlockProgress) {
+		s.save(blockIdx, prog.Checksum)
+		if next != nil {
+			next(blockIdx, prog)
+		}
+	}
+}
+
+// Done deletes the progress, once Mkfile succeeded.
+func (s *Saver) Done() error {
+	return s.Store.Delete(s.Record.EntryURI, s.Record.Fingerprint)
+}
@@ -0,0 +1,147 @@
+package up
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"qbox.me/api/resume"
+	"qbox.me/api/upload/uptest"
+	"sync"
+	"testing"
+)
+
+func TestPutMkfile(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+
+	data := make([]byte, 3*4096+10)
+	rand.New(rand.NewSource(1)).Read(data)
+	s, _ := NewService("up.test", srv.URL, 12, 1000, 1, nil, 1, 2)
+	s.Backoff = nil
+
+	n := s.BlockCount(int64(len(data)))
+	checksums := make([]string, n)
+	progs := make([]BlockProgress, n)
+	var (
+		mu       sync.Mutex
+		notified = make(map[int]string)
+	)
+	blockNotify := func(blockIdx int, checksum string) {
+		mu.Lock()
+		notified[blockIdx] = checksum
+		mu.Unlock()
+	}
+	chunkNotify := func(blockIdx int, prog *BlockProgress) {
+		if prog.Offset+prog.RestSize != s.blockSize(blockIdx, int64(len(data))) {
+			t.Error("inconsistent progress:", blockIdx, *prog)
+		}
+	}
+
+	// block 1 already put by a previous Put
+	first := make([]string, n)
+	if code, err := s.Put(bytes.NewReader(data), int64(len(data)), first, make([]BlockProgress, n),
+		func(int, string) {}, func(int, *BlockProgress) {}); err != nil {
+		t.Fatal("Put:", code, err)
+	}
+	checksums[1] = first[1]
+	chunks1, _ := srv.Chunks()
+
+	code, err := s.Put(bytes.NewReader(data), int64(len(data)), checksums, progs, blockNotify, chunkNotify)
+	if err != nil || code != 200 {
+		t.Fatal("Put:", code, err)
+	}
+	if _, ok := notified[1]; ok || len(notified) != n-1 {
+		t.Fatal("blocks notified:", notified)
+	}
+	if chunks, _ := srv.Chunks(); chunks-chunks1 != 2*5+1 {
+		t.Fatal("chunks put again:", chunks-chunks1)
+	}
+	for i := range checksums {
+		if checksums[i] != first[i] {
+			t.Fatal("checksum of block", i, checksums[i], "expected", first[i])
+		}
+	}
+
+	// all put: nothing is put again
+	chunks2, _ := srv.Chunks()
+	calls := 0
+	if code, err = s.Put(bytes.NewReader(data), int64(len(data)), checksums, make([]BlockProgress, n),
+		func(int, string) { calls++ }, func(int, *BlockProgress) { calls++ }); err != nil || code != 200 {
+		t.Fatal("Put of all put blocks:", code, err)
+	}
+	if chunks, _ := srv.Chunks(); chunks != chunks2 || calls != 0 {
+		t.Fatal("blocks put again:", chunks-chunks2, "notified", calls)
+	}
+	for i := range checksums {
+		if checksums[i] != first[i] {
+			t.Fatal("checksum of block", i, "overwritten")
+		}
+	}
+
+	var ret map[string]interface{}
+	if code, err = s.Mkfile(&ret, "/rs-mkfile/", "bucket:key", int64(len(data)), "", "", checksums); err != nil {
+		t.Fatal("Mkfile:", code, err)
+	}
+	if !bytes.Equal(srv.File("bucket:key"), data) || ret["hash"] != "fake" {
+		t.Fatal("the file made differs", ret)
+	}
+}
+
+func TestResumeLastChunk(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "progress.json")
+
+	data := make([]byte, 3*4096+10)
+	rand.New(rand.NewSource(2)).Read(data)
+	f, fsize := bytes.NewReader(data), int64(len(data))
+	s, _ := NewService("up.test", srv.URL, 12, 1000, 1, nil, 1, 2)
+	s.Backoff = nil
+
+	// the process dies after the last chunk of each block is saved, before
+	// the block is
+	n := s.BlockCount(fsize)
+	store, _ := resume.Open(path)
+	checksums, progs := make([]string, n), make([]BlockProgress, n)
+	saver, resumed, err := s.Resume(store, "bucket:key", f, fsize, checksums, progs)
+	if err != nil || resumed {
+		t.Fatal("Resume of a new upload:", resumed, err)
+	}
+	if code, err := s.Put(f, fsize, checksums, progs, func(int, string) {}, saver.ChunkNotify(nil)); err != nil {
+		t.Fatal("Put:", code, err)
+	}
+
+	store, _ = resume.Open(path)
+	checksums2, progs2 := make([]string, n), make([]BlockProgress, n)
+	if _, resumed, err = s.Resume(store, "bucket:key", f, fsize, checksums2, progs2); err != nil || !resumed {
+		t.Fatal("Resume:", resumed, err)
+	}
+	for i := range checksums {
+		if checksums2[i] != checksums[i] || checksums2[i] == "" {
+			t.Fatal("checksum of block", i, checksums2[i], "expected", checksums[i])
+		}
+	}
+	chunks1, _ := srv.Chunks()
+	if code, err := s.Put(f, fsize, checksums2, progs2, func(int, string) {}, func(int, *BlockProgress) {}); err != nil {
+		t.Fatal("Put of the resumed upload:", code, err)
+	}
+	if chunks, _ := srv.Chunks(); chunks != chunks1 {
+		t.Fatal("chunks put again:", chunks-chunks1)
+	}
+	var ret map[string]interface{}
+	if code, err := s.Mkfile(&ret, "/rs-mkfile/", "bucket:key", fsize, "", "", checksums2); err != nil {
+		t.Fatal("Mkfile:", code, err)
+	}
+	if !bytes.Equal(srv.File("bucket:key"), data) {
+		t.Fatal("the file made differs")
+	}
+}
@@ -2,58 +2,33 @@ package up2
 
 import (
 	"io"
-	"errors"
-	"sync"
-	"strings"
-	"strconv"
 	"net/http"
-	"hash/crc32"
-	"qbox.us/rpc"
-	"qbox.me/httputil"
-	"qbox.me/errcode"
+	"qbox.me/api/upload"
 )
 
-
+// Service is the resumable upload client of qbox.me/api/upload, kept for
+// the callers of this API; new code uses upload directly.
 type Service struct {
-	host, ip string
-	BlockBits uint
-	RPutChunkSize, RPutRetryTimes int
-	Conn *httputil.Client
+	*upload.Service
 }
 
 
 func New(host, ip string, blockbits uint, chunksize, retryTimes int, t http.RoundTripper) (s *Service, err error) {
-
-	if t == nil {
-		t = http.DefaultTransport
-	}
-	client := &http.Client{Transport: t}
-	s = &Service{host, ip, blockbits, chunksize, retryTimes, &httputil.Client{client}}
-	return
+	return &Service{upload.New(host, ip, blockbits, chunksize, retryTimes, t)}, nil
 }
 
-func (s *Service) BlockCount(fsize int64) int {
-	blockMask := int64((1 << s.BlockBits) - 1)
-	return int((fsize + blockMask) >> s.BlockBits)
-}
 
+type BlockputProgress = upload.BlockProgress
+type BlockError = upload.BlockError
+type RunError = upload.RunError
+type Crc32Error = upload.Crc32Error
+type ChunkPolicy = upload.ChunkPolicy
 
-type BlockputProgress struct {
-	Ctx string  `json:"ctx"`
-	Checksum string `json:"checksum"`
-	Crc32 uint32 `json:"crc32"`
-	Offset int64 `json:"offset"`
-}
+var ErrCanceled = upload.ErrCanceled
+var ErrIntegrity = upload.ErrIntegrity
 
 type RPtask struct {
-	*Service
-	EntryURI string
-	Type string
-	Size int64
-	Customer, Meta string
-	CallbackParams string
-	Body io.ReaderAt
-	Progress []BlockputProgress
+	*upload.Task
 	ChunkNotify, BlockNotify func(blockIdx int, prog *BlockputProgress)
 }
 
@@ -62,168 +37,37 @@ func (s *Service) NewRPtask(
 	entryURI, mimeType string, customer, meta, params string,
 	r io.ReaderAt, size int64, progs []BlockputProgress) (t *RPtask) {
 
-	blockcnt := int((size + (1 << s.BlockBits) - 1) >> s.BlockBits)
-	if progs == nil {
-		progs = make([]BlockputProgress, blockcnt)
-	}
-	return &RPtask{s, entryURI, mimeType, size, customer, meta, params, r, progs, nil, nil}
+	t = &RPtask{Task: s.NewTask(entryURI, r, size, progs)}
+	t.MimeType, t.Customer, t.Meta, t.CallbackParams = mimeType, customer, meta, params
+	t.Notify = []upload.Notifier{upload.NotifyFuncs{
+		OnChunk: func(blockIdx int, prog *BlockputProgress) {
+			if t.ChunkNotify != nil {
+				t.ChunkNotify(blockIdx, prog)
+			}
+		},
+		OnBlock: func(blockIdx int, prog *BlockputProgress, err error) {
+			if t.BlockNotify != nil {
+				t.BlockNotify(blockIdx, prog)
+			}
+		},
+	}}
+	return
 }
 
 
-// Running the resumable put task
+// Run puts the blocks by threadSize workers, then makes the file. taskQsize
+// is not used any more.
 func (t *RPtask) Run(taskQsize, threadSize int,
 	chunkNotify, blockNotify func(blockIdx int, prog *BlockputProgress)) (code int, err error) {
 
-	var (
-		wg sync.WaitGroup
-		failed bool
-	)
-	worker := func(tasks chan func()) {
-		for {
-			task := <- tasks
-			task()
-		}
-	}
-	blockcnt := len(t.Progress)
 	t.ChunkNotify = chunkNotify
 	t.BlockNotify = blockNotify
-
-	if taskQsize == 0 {
-		taskQsize = blockcnt
-	}
-	if threadSize == 0 {
-		threadSize = blockcnt
-	}
-
-	tasks := make(chan func(), taskQsize)
-	for i := 0; i < threadSize; i++ {
-		go worker(tasks)
-	}
-
-	wg.Add(blockcnt)
-	for i := 0; i < blockcnt; i++ {
-		blkIdx := i
-		task := func() {
-			defer wg.Done()
-			code, err = t.PutBlock(blkIdx)
-			if err != nil {
-				failed = true
-			}
-		}
-		tasks <- task
-	}
-	wg.Wait()
-
-	if failed {
-		return 400, err
-	}
-
-	return t.Mkfile()
-}
-
-
-func (t *RPtask) PutBlock(blockIdx int) (code int, err error) {
-	var (
-		url string
-		restsize, blocksize int64
-	)
-
-	h := crc32.NewIEEE()
-	prog := &t.Progress[blockIdx]
-	offbase := int64(blockIdx << t.BlockBits)
-
-	// blocksize
-	if blockIdx == len(t.Progress) - 1 {
-		blocksize = t.Size - offbase
-	} else {
-		blocksize = int64(1 << t.BlockBits)
-	}
-
-	initProg := func(p *BlockputProgress) {
-		p.Offset = 0
-		p.Ctx = ""
-		p.Crc32 = 0
-		p.Checksum = ""
-		restsize = blocksize
-	}
-
-	if prog.Ctx == "" {
-		initProg(prog)
-	}
-
-	for restsize > 0 {
-		bdlen := int64(t.RPutChunkSize)
-		if bdlen > restsize {
-			bdlen = restsize
-		}
-		retry := t.RPutRetryTimes
-	lzRetry:
-		h.Reset()
-		bd1 := io.NewSectionReader(t.Body, int64(offbase + prog.Offset), int64(bdlen))
-		bd := io.TeeReader(bd1, h)
-		if prog.Ctx == "" {
-			url = t.ip + "/mkblk/" + strconv.FormatInt(blocksize, 10)
-		} else {
-			url = t.ip + "/bput/" + prog.Ctx + "/" + strconv.FormatInt(prog.Offset, 10)
-		}
-		code, err = t.Conn.CallWithEx(prog, url, t.host, "application/octet-stream", bd, bdlen)
-		if err == nil {
-			if prog.Crc32 == h.Sum32() {
-				restsize = blocksize - prog.Offset
-				if t.ChunkNotify != nil {
-					t.ChunkNotify(blockIdx,prog)
-				}
-				continue
-			} else {
-				err = errors.New("ResumableBlockPut: Invalid Checksum")
-			}
-		}
-		if code == errcode.InvalidCtx {
-			initProg(prog)
-			err = errcode.EInvalidCtx
-			continue   // retry upload current block
-		}
-		if retry > 0 {
-			retry--
-			goto lzRetry
-		}
-		break
-	}
-	if t.BlockNotify != nil {
-		t.BlockNotify(blockIdx,prog)
-	}
-	return
+	return t.Task.Run(threadSize, nil)
 }
 
 
-
-
-
 func (t *RPtask) Mkfile() (code int, err error) {
-	var (
-		ctx string
-	)
-	for k,p := range t.Progress {
-		if k == len(t.Progress) - 1 {
-			ctx += p.Ctx
-		} else {
-			ctx += p.Ctx + ","
-		}
-	}
-	bd := []byte(ctx)
-	url := t.ip + "/rs-mkfile/" + rpc.EncodeURI(t.EntryURI)
-	url += "/fsize/" + strconv.FormatInt(t.Size, 10)
-	if t.Meta != "" {
-		url += "/meta/" + rpc.EncodeURI(t.Meta)
-	}
-	if t.Customer != "" {
-		url += "/customer/" + t.Customer
-	}
-	if t.CallbackParams != "" {
-		url += "/params/" + t.CallbackParams
-	}
-	code, err = t.Conn.CallWithEx(nil, url, t.host, "", strings.NewReader(string(bd)), int64(len(bd)))
-	return
+	return t.Task.Mkfile(nil)
 }
 
 func (s *Service) Put(
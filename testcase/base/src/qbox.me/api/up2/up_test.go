@@ -0,0 +1,134 @@
+package up2
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"qbox.me/api/upload/uptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTask(t *testing.T, srv *uptest.Server, data []byte, retryTimes int) *RPtask {
+	s, err := New("up.test", srv.URL, 12, 1000, retryTimes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Backoff = nil
+	return s.NewRPtask("bucket:key", "", "", "", "", bytes.NewReader(data), int64(len(data)), nil)
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// goroutines waits a little for the goroutines to exit, and counts them.
+func goroutines(max int) int {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100 && n > max; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	return n
+}
+
+func TestRun(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+
+	before := runtime.NumGoroutine()
+	data := testData(50*4096 + 123)
+	task := newTask(t, srv, data, 0)
+	var notified int32
+	code, err := task.Run(4, 8, func(int, *BlockputProgress) { atomic.AddInt32(&notified, 1) }, nil)
+	if err != nil || code != 200 {
+		t.Fatal("Run:", code, err)
+	}
+	if !bytes.Equal(srv.File("bucket:key"), data) {
+		t.Fatal("the file made differs")
+	}
+	if chunks, _ := srv.Chunks(); int(notified) != chunks {
+		t.Fatal("chunks notified:", notified, "put:", chunks)
+	}
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	if n := goroutines(before + 2); n > before+2 {
+		t.Fatal("workers left:", n-before)
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+	srv.Fail = func(ctx string, offset int64) int {
+		if offset == 2000 {
+			return 500
+		}
+		return 0
+	}
+
+	before := runtime.NumGoroutine()
+	data := testData(50*4096 + 123)
+	task := newTask(t, srv, data, 1)
+	_, err := task.Run(1, 2, nil, nil)
+	errs, ok := err.(RunError)
+	if !ok || len(errs) == 0 {
+		t.Fatal("Run should fail with a RunError:", err)
+	}
+	for _, e := range errs {
+		if e.Code != 500 || e.Block < 0 || e.Block >= 51 {
+			t.Fatal("unexpected block error:", e)
+		}
+	}
+	// the other blocks were canceled: at most a block per worker went on
+	if len(errs) > 2 {
+		t.Fatal("blocks failed after the first failure:", errs)
+	}
+	if srv.File("bucket:key") != nil {
+		t.Fatal("mkfile after a failure")
+	}
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	if n := goroutines(before + 2); n > before+2 {
+		t.Fatal("workers left:", n-before)
+	}
+}
+
+func TestCancelAndResume(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+
+	data := testData(20*4096 + 5)
+	task := newTask(t, srv, data, 0)
+	var chunks int32
+	_, err := task.Run(2, 4, func(int, *BlockputProgress) {
+		if atomic.AddInt32(&chunks, 1) == 10 {
+			task.Cancel()
+		}
+	}, nil)
+	if err != ErrCanceled {
+		t.Fatal("Run after Cancel:", err)
+	}
+	if srv.File("bucket:key") != nil {
+		t.Fatal("mkfile after Cancel")
+	}
+
+	put, _ := srv.Chunks()
+	task2 := newTask(t, srv, data, 0)
+	task2.Progress = task.Progress
+	if code, err := task2.Run(2, 4, nil, nil); err != nil {
+		t.Fatal("resumed Run:", code, err)
+	}
+	if !bytes.Equal(srv.File("bucket:key"), data) {
+		t.Fatal("the resumed file differs")
+	}
+	// 4096 bytes blocks by chunks of 1000: 5 chunks a block, 1 for the last
+	if total, _ := srv.Chunks(); total != 20*5+1 {
+		t.Fatal("chunks put:", put, "then", total-put)
+	}
+}
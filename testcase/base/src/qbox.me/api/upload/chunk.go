@@ -0,0 +1,156 @@
+package upload
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+
+// ChunkPolicy makes the chunk size adaptive. Each block starts with chunks
+// of ChunkSize, then each chunk put sizes the next one to take about
+// TargetTime at the throughput it was put, at most twice or half the size
+// of the chunk. A chunk failing halves the size of the next attempt, and
+// the size doesn't grow again in the block for the next 2 chunks. The size
+// stays in [MinSize, MaxSize], and is rounded to 1K. Zero fields take the
+// value of DefaultChunkPolicy.
+type ChunkPolicy struct {
+	MinSize    int `json:"min_size"`
+	MaxSize    int `json:"max_size"`    // the block size if 0
+	TargetTime int `json:"target_time"` // ms
+}
+
+var DefaultChunkPolicy = ChunkPolicy{MinSize: 16 << 10, TargetTime: 1000}
+
+// calmChunks is how many chunks after a failure are not grown.
+const calmChunks = 2
+
+// chunker sizes the chunks of a block.
+type chunker struct {
+	size     int // of the next chunk
+	min, max int
+	target   time.Duration // 0 for a fixed size
+	calm     int           // chunks left without growing
+}
+
+func (s *Service) newChunker(blocksize int64) *chunker {
+
+	c := &chunker{size: s.ChunkSize}
+	p := s.Adaptive
+	if p == nil {
+		return c
+	}
+	c.min, c.max, c.target = p.MinSize, p.MaxSize, time.Duration(p.TargetTime)*time.Millisecond
+	if c.min <= 0 {
+		c.min = DefaultChunkPolicy.MinSize
+	}
+	if c.max <= 0 || int64(c.max) > blocksize {
+		c.max = int(blocksize)
+	}
+	if c.min > c.max {
+		c.min = c.max
+	}
+	if c.target <= 0 {
+		c.target = time.Duration(DefaultChunkPolicy.TargetTime) * time.Millisecond
+	}
+	c.resize(c.size)
+	return c
+}
+
+func (c *chunker) resize(size int) {
+	if size >= 1<<10 {
+		size &^= 1<<10 - 1
+	}
+	if size < c.min {
+		size = c.min
+	}
+	if size > c.max {
+		size = c.max
+	}
+	c.size = size
+}
+
+// next returns the size of the next chunk, restsize bytes being left.
+func (c *chunker) next(restsize int64) int64 {
+	if int64(c.size) > restsize {
+		return restsize
+	}
+	return int64(c.size)
+}
+
+// done sizes the next chunk after n bytes were put in d.
+func (c *chunker) done(n int64, d time.Duration) {
+
+	if c.target == 0 || n < int64(c.size) {
+		return // the last chunk of the block tells little
+	}
+	size := c.size * 2
+	if d > 0 {
+		if s := float64(n) * float64(c.target) / float64(d); s < float64(size) {
+			size = int(s)
+		}
+	}
+	if size < c.size/2 {
+		size = c.size / 2
+	}
+	if c.calm > 0 {
+		c.calm--
+		if size > c.size {
+			size = c.size
+		}
+	}
+	c.resize(size)
+}
+
+// failed sizes the next attempt after a chunk failed.
+func (c *chunker) failed() {
+	if c.target == 0 {
+		return
+	}
+	c.calm = calmChunks
+	c.resize(c.size / 2)
+}
+
+// --------------------------------------------------------------------
+
+// ChunkStats sums up the sizes of the chunks put by a Task.
+type ChunkStats struct {
+	Chunks   int
+	Bytes    int64
+	Min, Max int64
+}
+
+func (s ChunkStats) String() string {
+	if s.Chunks == 0 {
+		return "no chunks"
+	}
+	return fmt.Sprintf("%v chunks of %v..%v bytes, avg %v", s.Chunks, s.Min, s.Max, s.Bytes/int64(s.Chunks))
+}
+
+type chunkStats struct {
+	mu sync.Mutex
+	ChunkStats
+}
+
+func (s *chunkStats) add(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Chunks == 0 || n < s.Min {
+		s.Min = n
+	}
+	if n > s.Max {
+		s.Max = n
+	}
+	s.Chunks++
+	s.Bytes += n
+}
+
+// ChunkStats returns the sizes of the chunks t put so far.
+func (t *Task) ChunkStats() ChunkStats {
+	t.chunks.mu.Lock()
+	defer t.chunks.mu.Unlock()
+	return t.chunks.ChunkStats
+}
+
+// --------------------------------------------------------------------
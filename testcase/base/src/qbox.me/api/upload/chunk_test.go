@@ -0,0 +1,88 @@
+package upload
+
+import (
+	"bytes"
+	"qbox.me/api/upload/uptest"
+	"testing"
+	"time"
+)
+
+func TestChunker(t *testing.T) {
+
+	s := New("up.test", "", 22, 256, 0, nil)
+	if c := s.newChunker(4 << 20); c.next(1<<20) != 256 {
+		t.Fatal("fixed chunk size:", c.size)
+	}
+
+	s.Adaptive = &ChunkPolicy{MinSize: 1 << 10, TargetTime: 1000}
+	c := s.newChunker(4 << 20)
+	if c.size != 1<<10 || c.max != 4<<20 {
+		t.Fatal("base size not clamped:", c.size, c.min, c.max)
+	}
+	// fast: doubled at most, up to the block size
+	for i := 0; i < 20; i++ {
+		c.done(int64(c.size), time.Millisecond)
+	}
+	if c.size != 4<<20 {
+		t.Fatal("grown to:", c.size)
+	}
+	// 1M a second: the next chunk takes about 1s, at most half as big
+	c.done(4<<20, 4*time.Second)
+	if c.size != 2<<20 {
+		t.Fatal("shrunk to:", c.size)
+	}
+	c.done(2<<20, 2*time.Second)
+	if c.size != 1<<20 {
+		t.Fatal("at 1M/s:", c.size)
+	}
+	// a failure halves it, and it does not grow for 2 chunks
+	c.failed()
+	c.done(512<<10, time.Millisecond)
+	c.done(512<<10, time.Millisecond)
+	if c.size != 512<<10 {
+		t.Fatal("after a failure:", c.size)
+	}
+	c.done(512<<10, time.Millisecond)
+	if c.size != 1<<20 {
+		t.Fatal("not grown again:", c.size)
+	}
+	// a short last chunk changes nothing
+	c.done(10, time.Hour)
+	if c.next(100) != 100 || c.size != 1<<20 {
+		t.Fatal("after the last chunk:", c.size)
+	}
+}
+
+func TestAdaptiveRun(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+	failed := false
+	srv.Fail = func(ctx string, offset int64) int {
+		if offset > 20000 && !failed {
+			failed = true
+			return 503
+		}
+		return 0
+	}
+
+	// blocks of 64K, from chunks of 1000
+	data := testData(3*65536 + 5000)
+	s := New("up.test", srv.URL, 16, 1000, 1, nil)
+	s.Backoff = nil
+	s.Adaptive = &ChunkPolicy{MinSize: 512}
+	task := s.NewTask("bucket:adaptive", bytes.NewReader(data), int64(len(data)), nil)
+	if code, err := task.Run(1, nil); err != nil {
+		t.Fatal("Run:", code, err)
+	}
+	if !bytes.Equal(srv.File("bucket:adaptive"), data) {
+		t.Fatal("the file made differs")
+	}
+	st := task.ChunkStats()
+	if st.Bytes != int64(len(data)) || st.Max <= 1024 || st.Chunks >= len(data)/1000 {
+		t.Fatal("chunks:", st)
+	}
+	if !failed {
+		t.Fatal("no chunk failed")
+	}
+}
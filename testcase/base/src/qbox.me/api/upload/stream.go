@@ -0,0 +1,98 @@
+package upload
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// NewStreamTask returns the task of putting what is read from r, of a size
+// unknown before its end, see RunStream.
+func (s *Service) NewStreamTask(entryURI string) *Task {
+	return &Task{Service: s, EntryURI: entryURI, canceled: make(chan struct{})}
+}
+
+// RunStream puts what r reads, then makes the file. r is read block by
+// block, each block being put once read while the next ones are read, by
+// inFlight workers. As many blocks as workers are buffered at most. The
+// size is only known at the end of r, and is then set in t.Size with the
+// progress of the blocks in t.Progress. A stream can't be resumed, t.Store
+// is not used.
+func (t *Task) RunStream(r io.Reader, inFlight int, ret interface{}) (code int, err error) {
+
+	if inFlight <= 0 {
+		inFlight = 1
+	}
+	blockSize := 1 << t.BlockBits
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		errs     RunError
+		progs    []*BlockProgress
+		size     int64
+		stop     = make(chan struct{})
+		stopOnce sync.Once
+	)
+	fail := func(e BlockError) {
+		mu.Lock()
+		errs = append(errs, e)
+		mu.Unlock()
+		stopOnce.Do(func() { close(stop) })
+	}
+	// the buffers, allocated when first needed
+	bufs := make(chan []byte, inFlight)
+	for i := 0; i < inFlight; i++ {
+		bufs <- nil
+	}
+
+read:
+	for blkIdx := 0; ; blkIdx++ {
+		var buf []byte
+		select {
+		case buf = <-bufs:
+		case <-stop:
+			break read
+		case <-t.canceled:
+			break read
+		}
+		if buf == nil {
+			buf = make([]byte, blockSize)
+		}
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			prog := new(BlockProgress)
+			progs = append(progs, prog)
+			size += int64(n)
+			wg.Add(1)
+			go func(blkIdx int, body []byte, prog *BlockProgress) {
+				defer wg.Done()
+				defer func() { bufs <- buf }()
+				code, err := t.putChunks(blkIdx, bytes.NewReader(body), int64(len(body)), prog, stop)
+				if err != nil && err != ErrCanceled {
+					fail(BlockError{blkIdx, code, err})
+				}
+			}(blkIdx, buf[:n], prog)
+		} else {
+			bufs <- buf
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			fail(BlockError{blkIdx, 0, rerr})
+			break
+		}
+	}
+	wg.Wait()
+
+	t.Size = size
+	t.Progress = make([]BlockProgress, len(progs))
+	for i, p := range progs {
+		t.Progress[i] = *p
+	}
+	if code, err = t.result(errs, stop); err != nil {
+		return
+	}
+	return t.Mkfile(ret)
+}
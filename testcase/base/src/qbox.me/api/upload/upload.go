@@ -0,0 +1,523 @@
+// Package upload is the client of the resumable upload protocol of the up
+// service: a file is cut in blocks of 1<<BlockBits bytes, each put by
+// chunks with mkblk then bput, and made from the ctxs of its blocks with
+// mkfile. Blocks are put concurrently, and a Task keeps the progress of
+// each, to be resumed by a later Task after a failure.
+//
+// qbox.me/api/up and qbox.me/api/up2 are compatibility wrappers of it.
+package upload
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"qbox.me/api/resume"
+	"qbox.me/errcode"
+	"qbox.me/httputil"
+	"qbox.me/log"
+	"qbox.us/rpc"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultBlockBits = 22
+	DefaultChunkSize = 256 << 10
+)
+
+// Crc32Header carries the crc32 of a chunk, in decimal, for the server to
+// check the chunk against it, answering errcode.BadCrc32 on a mismatch.
+const Crc32Header = "X-Qiniu-Crc32"
+
+type Service struct {
+	host, ip   string
+	BlockBits  uint
+	ChunkSize  int
+	RetryTimes int // of a chunk, after the first attempt
+	Conn       *httputil.Client
+	Backoff    *httputil.RetryPolicy // delay between chunk retries, default if nil
+	SendCrc32  bool                  // send the crc32 of each chunk in Crc32Header
+	Adaptive   *ChunkPolicy          // adapts the chunk size from ChunkSize if not nil
+}
+
+func New(host, ip string, blockBits uint, chunkSize, retryTimes int, t http.RoundTripper) *Service {
+
+	if blockBits == 0 {
+		blockBits = DefaultBlockBits
+	}
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if t == nil {
+		t = httputil.NewLimitTransport(http.DefaultTransport, httputil.DefaultLimiter)
+	}
+	client := &http.Client{Transport: t}
+	return &Service{host, ip, blockBits, chunkSize, retryTimes, &httputil.Client{Client: client}, nil, false, nil}
+}
+
+func (s *Service) BlockCount(fsize int64) int {
+	blockMask := int64((1 << s.BlockBits) - 1)
+	return int((fsize + blockMask) >> s.BlockBits)
+}
+
+// BlockProgress is the progress of a block. Offset is how much of it was
+// put, Ctx and Checksum what the server answered for the last chunk, and
+// Crc32 the crc32 of that chunk. A block with no Ctx is put from its start.
+type BlockProgress struct {
+	Ctx      string `json:"ctx"`
+	Checksum string `json:"checksum"`
+	Crc32    uint32 `json:"crc32"`
+	Offset   int64  `json:"offset"`
+}
+
+// --------------------------------------------------------------------
+
+// Notifier is told of the progress of a Task, by its concurrent workers.
+type Notifier interface {
+	Chunk(blockIdx int, prog *BlockProgress)
+	Block(blockIdx int, prog *BlockProgress, err error) // err is nil if the block was put
+}
+
+// NotifyFuncs is a Notifier calling the funcs which are not nil.
+type NotifyFuncs struct {
+	OnChunk func(blockIdx int, prog *BlockProgress)
+	OnBlock func(blockIdx int, prog *BlockProgress, err error)
+}
+
+func (n NotifyFuncs) Chunk(blockIdx int, prog *BlockProgress) {
+	if n.OnChunk != nil {
+		n.OnChunk(blockIdx, prog)
+	}
+}
+
+func (n NotifyFuncs) Block(blockIdx int, prog *BlockProgress, err error) {
+	if n.OnBlock != nil {
+		n.OnBlock(blockIdx, prog, err)
+	}
+}
+
+// --------------------------------------------------------------------
+
+// Task is the upload of Size bytes of Body to EntryURI.
+type Task struct {
+	*Service
+	EntryURI string
+	Body     io.ReaderAt
+	Size     int64
+	Progress []BlockProgress
+
+	// mkfile parameters
+	MimeType       string
+	Customer, Meta string
+	CallbackParams string
+
+	Notify []Notifier
+	Store  *resume.Store // where the progress is saved, see Resume
+
+	record     *resume.Record
+	canceled   chan struct{} // closed by Cancel
+	cancelOnce sync.Once
+	mismatches int32
+	chunks     chunkStats
+}
+
+// NewTask returns the task of putting r, resuming progs if not nil.
+func (s *Service) NewTask(entryURI string, r io.ReaderAt, size int64, progs []BlockProgress) *Task {
+
+	if progs == nil {
+		progs = make([]BlockProgress, s.BlockCount(size))
+	}
+	return &Task{
+		Service: s, EntryURI: entryURI, Body: r, Size: size, Progress: progs,
+		canceled: make(chan struct{}),
+	}
+}
+
+// ErrCanceled is returned for the blocks not put because the task was
+// canceled, by Cancel or by the failure of another block.
+var ErrCanceled = errors.New("resumable put canceled")
+
+// ErrIntegrity is what a Crc32Error is, to tell with errors.Is a chunk
+// corrupted on its way from the other failures of a Run.
+var ErrIntegrity = errors.New("data integrity error")
+
+// Crc32Error is a chunk whose crc32 differs from the crc32 the server
+// answered for it, or which the server rejected as not matching the crc32
+// sent in Crc32Header.
+type Crc32Error struct {
+	Block    int
+	Offset   int64 // of the chunk in the block
+	Local    uint32
+	Remote   uint32 // 0 if Rejected
+	Rejected bool
+}
+
+func (e *Crc32Error) Error() string {
+	if e.Rejected {
+		return fmt.Sprintf("crc32 mismatch: chunk at %v of block %v, crc32 %08x rejected by the server",
+			e.Offset, e.Block, e.Local)
+	}
+	return fmt.Sprintf("crc32 mismatch: chunk at %v of block %v, crc32 %08x, server answered %08x",
+		e.Offset, e.Block, e.Local, e.Remote)
+}
+
+func (e *Crc32Error) Unwrap() error {
+	return ErrIntegrity
+}
+
+// BlockError is the failure of a block of a Run.
+type BlockError struct {
+	Block int
+	Code  int
+	Err   error
+}
+
+func (e BlockError) Error() string {
+	return "block " + strconv.Itoa(e.Block) + ": " + strconv.Itoa(e.Code) + " " + e.Err.Error()
+}
+
+func (e BlockError) Unwrap() error {
+	return e.Err
+}
+
+// RunError lists the blocks which failed in a Run, in the order they did.
+// The blocks canceled because of them are not listed.
+type RunError []BlockError
+
+func (e RunError) Error() string {
+	msgs := make([]string, len(e))
+	for i, b := range e {
+		msgs[i] = b.Error()
+	}
+	return strconv.Itoa(len(e)) + " block(s) failed: " + strings.Join(msgs, "; ")
+}
+
+func (e RunError) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, b := range e {
+		errs[i] = b
+	}
+	return errs
+}
+
+// Crc32Mismatches returns how many chunks were put again because of a
+// Crc32Error.
+func (t *Task) Crc32Mismatches() int {
+	return int(atomic.LoadInt32(&t.mismatches))
+}
+
+// Cancel stops the task: the blocks not started are not put, the others
+// stop after their current chunk, and Run returns ErrCanceled. A canceled
+// task stays so, its Progress is resumed by a new task.
+func (t *Task) Cancel() {
+	t.cancelOnce.Do(func() { close(t.canceled) })
+}
+
+// stopped tells whether the blocks must stop, stop being closed on the
+// first failure of a Run.
+func (t *Task) stopped(stop <-chan struct{}) bool {
+	select {
+	case <-t.canceled:
+		return true
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Task) blockSize(blockIdx int) int64 {
+	offbase := int64(blockIdx) << t.BlockBits
+	if blockIdx == len(t.Progress)-1 {
+		return t.Size - offbase
+	}
+	return int64(1) << t.BlockBits
+}
+
+// Done tells whether the block blockIdx was put.
+func (t *Task) Done(blockIdx int) bool {
+	p := &t.Progress[blockIdx]
+	return p.Ctx != "" && p.Offset == t.blockSize(blockIdx)
+}
+
+// Run puts the blocks by threads workers, as many as blocks if 0, then
+// makes the file, decoding the answer of mkfile in ret if not nil.
+func (t *Task) Run(threads int, ret interface{}) (code int, err error) {
+
+	if code, err = t.PutBlocks(threads, nil); err != nil {
+		return
+	}
+	return t.Mkfile(ret)
+}
+
+// PutBlocks puts the blocks listed, all if nil, by threads workers, as many
+// as blocks if 0. The first block failing cancels the blocks left, and
+// PutBlocks returns a RunError once the workers are done.
+func (t *Task) PutBlocks(threads int, blockIdxs []int) (code int, err error) {
+
+	if blockIdxs == nil {
+		blockIdxs = make([]int, len(t.Progress))
+		for i := range blockIdxs {
+			blockIdxs[i] = i
+		}
+	}
+	if threads <= 0 || threads > len(blockIdxs) {
+		threads = len(blockIdxs)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		errs     RunError
+		stop     = make(chan struct{})
+		stopOnce sync.Once
+	)
+	blocks := make(chan int, threads)
+	wg.Add(threads)
+	for i := 0; i < threads; i++ {
+		go func() {
+			defer wg.Done()
+			for blkIdx := range blocks {
+				code, err := t.putBlock(blkIdx, stop)
+				if err == nil || err == ErrCanceled {
+					continue
+				}
+				mu.Lock()
+				errs = append(errs, BlockError{blkIdx, code, err})
+				mu.Unlock()
+				stopOnce.Do(func() { close(stop) })
+			}
+		}()
+	}
+
+feed:
+	for _, i := range blockIdxs {
+		select {
+		case blocks <- i:
+		case <-stop:
+			break feed
+		case <-t.canceled:
+			break feed
+		}
+	}
+	close(blocks)
+	wg.Wait()
+	return t.result(errs, stop)
+}
+
+func (t *Task) result(errs RunError, stop <-chan struct{}) (code int, err error) {
+
+	if len(errs) > 0 {
+		code = errs[0].Code
+		if code/100 == 2 || code == 0 {
+			code = 400
+		}
+		return code, errs
+	}
+	if t.stopped(stop) {
+		return 400, ErrCanceled
+	}
+	return 200, nil
+}
+
+// PutBlock puts the block blockIdx from its Progress.
+func (t *Task) PutBlock(blockIdx int) (code int, err error) {
+	return t.putBlock(blockIdx, nil)
+}
+
+func (t *Task) putBlock(blockIdx int, stop <-chan struct{}) (code int, err error) {
+	offbase := int64(blockIdx) << t.BlockBits
+	blocksize := t.blockSize(blockIdx)
+	body := io.NewSectionReader(t.Body, offbase, blocksize)
+	return t.putChunks(blockIdx, body, blocksize, &t.Progress[blockIdx], stop)
+}
+
+// putChunks puts the block blockIdx of blocksize bytes read from body, from
+// where prog says.
+func (t *Task) putChunks(
+	blockIdx int, body io.ReaderAt, blocksize int64, prog *BlockProgress, stop <-chan struct{}) (code int, err error) {
+
+	h := crc32.NewIEEE()
+	if prog.Ctx == "" {
+		*prog = BlockProgress{}
+	}
+	restsize := blocksize - prog.Offset
+	chunks := t.newChunker(blocksize)
+
+	for restsize > 0 {
+		if t.stopped(stop) {
+			return 400, ErrCanceled
+		}
+		retry := t.RetryTimes
+	lzRetry:
+		bdlen := chunks.next(restsize)
+		var url string
+		if prog.Ctx == "" {
+			url = t.ip + "/mkblk/" + strconv.FormatInt(blocksize, 10)
+		} else {
+			url = t.ip + "/bput/" + prog.Ctx + "/" + strconv.FormatInt(prog.Offset, 10)
+		}
+		var ret BlockProgress
+		begin := time.Now()
+		code, err = t.putChunk(&ret, url, io.NewSectionReader(body, prog.Offset, bdlen), h)
+		if err == nil {
+			if ret.Crc32 == h.Sum32() {
+				chunks.done(bdlen, time.Since(begin))
+				t.chunks.add(bdlen)
+				*prog = ret
+				restsize = blocksize - prog.Offset
+				t.save(blockIdx, prog)
+				for _, n := range t.Notify {
+					n.Chunk(blockIdx, prog)
+				}
+				continue
+			}
+			err = &Crc32Error{Block: blockIdx, Offset: prog.Offset, Local: h.Sum32(), Remote: ret.Crc32}
+		} else if code == errcode.BadCrc32 && t.SendCrc32 {
+			err = &Crc32Error{Block: blockIdx, Offset: prog.Offset, Local: h.Sum32(), Rejected: true}
+		}
+		if _, ok := err.(*Crc32Error); ok {
+			atomic.AddInt32(&t.mismatches, 1)
+			log.Warn("upload:", t.EntryURI, err)
+		}
+		if code == errcode.InvalidCtx {
+			// the ctx expired, e.g. saved by a run too long ago
+			*prog = BlockProgress{}
+			restsize = blocksize
+			t.save(blockIdx, prog)
+			err = errcode.EInvalidCtx
+			continue // retry upload current block
+		}
+		if retry > 0 {
+			retry--
+			chunks.failed()
+			select {
+			case <-time.After(t.Backoff.Delay(t.RetryTimes - retry)):
+			case <-t.canceled:
+				return 400, ErrCanceled
+			case <-stop:
+				return 400, ErrCanceled
+			}
+			goto lzRetry
+		}
+		break
+	}
+	for _, n := range t.Notify {
+		n.Block(blockIdx, prog, err)
+	}
+	return
+}
+
+// putChunk posts chunk to url, h summing its crc32. To send the crc32 in
+// Crc32Header, the chunk is read twice.
+func (t *Task) putChunk(ret *BlockProgress, url string, chunk *io.SectionReader, h hash.Hash32) (code int, err error) {
+
+	h.Reset()
+	if !t.SendCrc32 {
+		return t.Conn.CallWithEx(ret, url, t.host, "application/octet-stream", io.TeeReader(chunk, h), chunk.Size())
+	}
+	if _, err = io.Copy(h, chunk); err != nil {
+		return 400, err
+	}
+	header := http.Header{}
+	header.Set(Crc32Header, strconv.FormatUint(uint64(h.Sum32()), 10))
+	return t.Conn.CallWithHeaderEx(ret, url, t.host, header, "application/octet-stream",
+		io.NewSectionReader(chunk, 0, chunk.Size()), chunk.Size())
+}
+
+// Mkfile makes the file from the ctxs of the blocks put, decoding the
+// answer in ret if not nil. The progress saved is then deleted.
+func (t *Task) Mkfile(ret interface{}) (code int, err error) {
+
+	ctxs := make([]string, len(t.Progress))
+	for i, p := range t.Progress {
+		ctxs[i] = p.Ctx
+	}
+	bd := strings.Join(ctxs, ",")
+	url := t.ip + "/rs-mkfile/" + rpc.EncodeURI(t.EntryURI)
+	url += "/fsize/" + strconv.FormatInt(t.Size, 10)
+	if t.MimeType != "" {
+		url += "/mimeType/" + rpc.EncodeURI(t.MimeType)
+	}
+	if t.Meta != "" {
+		url += "/meta/" + rpc.EncodeURI(t.Meta)
+	}
+	if t.Customer != "" {
+		url += "/customer/" + t.Customer
+	}
+	if t.CallbackParams != "" {
+		url += "/params/" + t.CallbackParams
+	}
+	code, err = t.Conn.CallWithEx(ret, url, t.host, "", strings.NewReader(bd), int64(len(bd)))
+	if err == nil && t.Store != nil {
+		if err1 := t.Store.Delete(t.EntryURI, t.record.Fingerprint); err1 != nil {
+			log.Warn("upload: delete progress failed:", t.EntryURI, err1)
+		}
+	}
+	return
+}
+
+// MkfileChecksums makes entry from the checksums of its blocks, with the
+// mkfile command cmd, e.g. "/rs-mkfile/", as done by qbox.me/api/up.
+func (s *Service) MkfileChecksums(
+	ret interface{}, cmd, entry string,
+	fsize int64, params, callbackParams string, checksums []string) (code int, err error) {
+
+	if callbackParams != "" {
+		params += "/params/" + httputil.EncodeURI(callbackParams)
+	}
+	body := make([]byte, 20*len(checksums))
+	for i, checksum := range checksums {
+		b, err2 := base64.URLEncoding.DecodeString(checksum)
+		if err2 != nil {
+			code, err = 400, errors.New("mkfile error")
+			return
+		}
+		copy(body[i*20:], b)
+	}
+	code, err = s.Conn.CallWithEx(
+		ret, s.ip+cmd+httputil.EncodeURI(entry)+"/fsize/"+strconv.FormatInt(fsize, 10)+params,
+		s.host, "application/octet-stream", bytes.NewReader(body), int64(len(body)))
+	return
+}
+
+// --------------------------------------------------------------------
+
+// Resume makes the task save its progress in store on each chunk put, and
+// loads the progress a previous run saved there for the same entry and
+// content, if any. The progress is deleted once the file is made.
+func (t *Task) Resume(store *resume.Store) (resumed bool, err error) {
+
+	fp, err := resume.Fingerprint(t.Body, t.Size)
+	if err != nil {
+		return
+	}
+	t.Store = store
+	t.record = store.Load(t.EntryURI, fp, t.Size, t.BlockBits)
+	if t.record != nil && len(t.record.Blocks) == len(t.Progress) {
+		for i, b := range t.record.Blocks {
+			t.Progress[i] = BlockProgress{b.Ctx, b.Checksum, b.Crc32, b.Offset}
+		}
+		return true, nil
+	}
+	t.record = resume.NewRecord(t.EntryURI, fp, t.Size, t.BlockBits)
+	return
+}
+
+func (t *Task) save(blockIdx int, p *BlockProgress) {
+	if t.Store == nil {
+		return
+	}
+	err := t.Store.SaveBlock(t.record, blockIdx, resume.Block{Ctx: p.Ctx, Offset: p.Offset, Checksum: p.Checksum, Crc32: p.Crc32})
+	if err != nil {
+		log.Warn("upload: save progress failed:", t.EntryURI, err)
+	}
+}
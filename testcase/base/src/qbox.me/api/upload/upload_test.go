@@ -0,0 +1,312 @@
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"qbox.me/api/resume"
+	"qbox.me/api/upload/uptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// blocks of 4096 bytes, put by chunks of 1000
+func newTestTask(srv *uptest.Server, data []byte) *Task {
+	s := New("up.test", srv.URL, 12, 1000, 1, nil)
+	s.Backoff = nil
+	return s.NewTask("bucket:key", bytes.NewReader(data), int64(len(data)), nil)
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+type countNotifier struct {
+	mu     sync.Mutex
+	chunks map[int]int
+	blocks map[int]error
+}
+
+func (n *countNotifier) Chunk(blockIdx int, prog *BlockProgress) {
+	n.mu.Lock()
+	n.chunks[blockIdx]++
+	n.mu.Unlock()
+}
+
+func (n *countNotifier) Block(blockIdx int, prog *BlockProgress, err error) {
+	n.mu.Lock()
+	n.blocks[blockIdx] = err
+	n.mu.Unlock()
+}
+
+func TestRunNotify(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+
+	data := testData(3*4096 + 10)
+	task := newTestTask(srv, data)
+	n := &countNotifier{chunks: make(map[int]int), blocks: make(map[int]error)}
+	task.Notify = []Notifier{n, NotifyFuncs{}}
+
+	if code, err := task.PutBlocks(2, []int{0, 2}); err != nil || code != 200 {
+		t.Fatal("PutBlocks:", code, err)
+	}
+	if !task.Done(0) || task.Done(1) || !task.Done(2) || task.Done(3) {
+		t.Fatal("Done:", task.Progress)
+	}
+	if len(n.chunks) != 2 || n.chunks[0] != 5 || n.chunks[2] != 5 || len(n.blocks) != 2 {
+		t.Fatal("notified:", n.chunks, n.blocks)
+	}
+	if code, err := task.Run(0, nil); err != nil {
+		t.Fatal("Run:", code, err)
+	}
+	if !bytes.Equal(srv.File("bucket:key"), data) {
+		t.Fatal("the file made differs")
+	}
+	// the blocks done were not put again
+	if chunks, _ := srv.Chunks(); chunks != 3*5+1 {
+		t.Fatal("chunks put:", chunks)
+	}
+}
+
+func TestBadCrc32(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+	var bad int32
+	srv.BadCrc32 = func(ctx string, offset int64) bool {
+		return offset == 1000 && atomic.AddInt32(&bad, 1) == 1
+	}
+
+	data := testData(4096)
+	task := newTestTask(srv, data)
+	if code, err := task.Run(1, nil); err != nil {
+		t.Fatal("Run:", code, err)
+	}
+	// the chunk answered a bad crc32 was put again, from the same ctx
+	if !bytes.Equal(srv.File("bucket:key"), data) {
+		t.Fatal("the file made differs")
+	}
+	if task.Crc32Mismatches() != 1 {
+		t.Fatal("crc32 mismatches:", task.Crc32Mismatches())
+	}
+
+	srv.BadCrc32 = func(string, int64) bool { return true }
+	task = newTestTask(srv, data)
+	_, err := task.Run(1, nil)
+	var crcErr *Crc32Error
+	if !errors.Is(err, ErrIntegrity) || !errors.As(err, &crcErr) || crcErr.Rejected {
+		t.Fatal("Run on bad crc32s:", err)
+	}
+	if task.Progress[0].Offset != 0 {
+		t.Fatal("a chunk with a bad crc32 counted as put:", task.Progress[0])
+	}
+}
+
+// corrupter flips a byte of the chunks it is asked to.
+type corrupter struct {
+	corrupt func(req *http.Request) bool
+}
+
+func (c corrupter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && c.corrupt(req) {
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if len(body) > 0 {
+			body[0] ^= 0xff
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCorruptedChunk(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+
+	data := testData(2 * 4096)
+	for _, send := range []bool{false, true} {
+		var n int32
+		c := corrupter{func(req *http.Request) bool {
+			return strings.HasSuffix(req.URL.Path, "/2000") && atomic.AddInt32(&n, 1) == 1
+		}}
+		s := New("up.test", srv.URL, 12, 1000, 1, c)
+		s.Backoff, s.SendCrc32 = nil, send
+		sent := srv.Crc32Sent()
+		task := s.NewTask("bucket:corrupted", bytes.NewReader(data), int64(len(data)), nil)
+		if code, err := task.Run(1, nil); err != nil {
+			t.Fatal("Run:", send, code, err)
+		}
+		if !bytes.Equal(srv.File("bucket:corrupted"), data) {
+			t.Fatal("the file made differs:", send)
+		}
+		if task.Crc32Mismatches() != 1 {
+			t.Fatal("crc32 mismatches:", send, task.Crc32Mismatches())
+		}
+		if sent = srv.Crc32Sent() - sent; send && sent != 2*5+1 || !send && sent != 0 {
+			t.Fatal("chunks sent with a crc32:", send, sent)
+		}
+	}
+
+	// checked by the server
+	s := New("up.test", srv.URL, 12, 1000, 2, corrupter{func(*http.Request) bool { return true }})
+	s.Backoff, s.SendCrc32 = nil, true
+	task := s.NewTask("bucket:corrupted", bytes.NewReader(data), int64(len(data)), nil)
+	code, err := task.Run(1, nil)
+	var crcErr *Crc32Error
+	if !errors.Is(err, ErrIntegrity) || !errors.As(err, &crcErr) || !crcErr.Rejected || code != 406 {
+		t.Fatal("Run of corrupted chunks:", code, err)
+	}
+	if task.Crc32Mismatches() != 3 {
+		t.Fatal("crc32 mismatches:", task.Crc32Mismatches())
+	}
+}
+
+func TestInvalidCtx(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+
+	data := testData(2*4096 + 1)
+	task := newTestTask(srv, data)
+	task.Progress[1] = BlockProgress{Ctx: "expired", Offset: 2000}
+	if code, err := task.Run(0, nil); err != nil {
+		t.Fatal("Run:", code, err)
+	}
+	if !bytes.Equal(srv.File("bucket:key"), data) {
+		t.Fatal("the file made differs")
+	}
+}
+
+func TestResume(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "progress.json")
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+
+	data := testData(6*4096 + 100)
+	store, _ := resume.Open(path)
+	task := newTestTask(srv, data)
+	if resumed, err := task.Resume(store); err != nil || resumed {
+		t.Fatal("Resume of nothing:", resumed, err)
+	}
+	var chunks int32
+	task.Notify = []Notifier{NotifyFuncs{OnChunk: func(int, *BlockProgress) {
+		if atomic.AddInt32(&chunks, 1) == 12 {
+			task.Cancel()
+		}
+	}}}
+	if _, err = task.Run(2, nil); err != ErrCanceled {
+		t.Fatal("Run after Cancel:", err)
+	}
+	_, sent1 := srv.Chunks()
+
+	// a later run
+	store, _ = resume.Open(path)
+	task = newTestTask(srv, data)
+	if resumed, err := task.Resume(store); err != nil || !resumed {
+		t.Fatal("Resume:", resumed, err)
+	}
+	if code, err := task.Run(2, nil); err != nil {
+		t.Fatal("resumed Run:", code, err)
+	}
+	if !bytes.Equal(srv.File("bucket:key"), data) {
+		t.Fatal("the resumed file differs")
+	}
+	if _, sent := srv.Chunks(); sent != int64(len(data)) {
+		t.Fatal("bytes put:", sent1, "then", sent-sent1)
+	}
+	store, _ = resume.Open(path)
+	if store.Load("bucket:key", task.record.Fingerprint, task.Size, task.BlockBits) != nil {
+		t.Fatal("progress kept after mkfile")
+	}
+}
+
+type errReader struct {
+	r   io.Reader
+	n   int // bytes read before failing
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, e.err
+	}
+	if len(p) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= n
+	return n, err
+}
+
+func TestRunStream(t *testing.T) {
+
+	srv := uptest.NewServer()
+	defer srv.Close()
+	var inFlight, maxInFlight int32
+	srv.Fail = func(ctx string, offset int64) int {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		return 0
+	}
+
+	for _, size := range []int{0, 10, 4096, 3*4096 + 500, 8 * 4096} {
+		data := testData(size)
+		s := New("up.test", srv.URL, 12, 1000, 1, nil)
+		task := s.NewStreamTask("bucket:stream")
+		code, err := task.RunStream(iotest.HalfReader(bytes.NewReader(data)), 3, nil)
+		if err != nil {
+			t.Fatal("RunStream:", size, code, err)
+		}
+		if task.Size != int64(size) || len(task.Progress) != s.BlockCount(int64(size)) {
+			t.Fatal("RunStream size:", task.Size, len(task.Progress), "expected", size)
+		}
+		if !bytes.Equal(srv.File("bucket:stream"), data) {
+			t.Fatal("the file streamed differs:", size)
+		}
+	}
+	if maxInFlight > 3 {
+		t.Fatal("blocks in flight:", maxInFlight)
+	}
+
+	// a read error fails the stream, and no file is made
+	srv.Fail = nil
+	data := testData(5 * 4096)
+	task := New("up.test", srv.URL, 12, 1000, 1, nil).NewStreamTask("bucket:broken")
+	broken := errors.New("broken source")
+	_, err := task.RunStream(&errReader{bytes.NewReader(data), 2*4096 + 7, broken}, 2, nil)
+	errs, ok := err.(RunError)
+	if !ok || errs[0].Err != broken || errs[0].Block != 2 {
+		t.Fatal("RunStream of a broken source:", err)
+	}
+	if srv.File("bucket:broken") != nil {
+		t.Fatal("mkfile of a broken stream")
+	}
+}
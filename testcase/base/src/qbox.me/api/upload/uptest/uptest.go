@@ -0,0 +1,169 @@
+// Package uptest is a fake up service keeping the blocks in memory, to test
+// the resumable upload clients.
+package uptest
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"qbox.me/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type blockRet struct {
+	Ctx      string `json:"ctx"`
+	Checksum string `json:"checksum"`
+	Crc32    uint32 `json:"crc32"`
+	Offset   int64  `json:"offset"`
+}
+
+// Server answers mkblk, bput, rs-mkfile from ctxs and mkfile from the
+// checksums of the blocks, as the up service does. A ctx changes with each
+// chunk, and a bput at another offset than the end of the block so far is
+// answered 701.
+type Server struct {
+	*httptest.Server
+
+	// Fail, if set, is asked the status to answer a chunk with instead of
+	// putting it, ctx being "" for mkblk.
+	Fail func(ctx string, offset int64) int
+
+	// BadCrc32, if set, is asked whether to answer a chunk with a wrong crc32.
+	BadCrc32 func(ctx string, offset int64) bool
+
+	chunks    int32
+	bytes     int64
+	crc32Sent int32
+
+	mu     sync.Mutex
+	seq    int
+	blocks map[string][]byte // by ctx
+	sums   map[string][]byte // blocks by checksum
+	files  map[string][]byte // by entry URI
+}
+
+func NewServer() *Server {
+	s := &Server{
+		blocks: make(map[string][]byte), sums: make(map[string][]byte), files: make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Chunks returns the count and the bytes of the chunks put.
+func (s *Server) Chunks() (n int, bytes int64) {
+	return int(atomic.LoadInt32(&s.chunks)), atomic.LoadInt64(&s.bytes)
+}
+
+// Crc32Sent returns how many chunks came with a crc32 header. Those not
+// matching it are answered 406.
+func (s *Server) Crc32Sent() int {
+	return int(atomic.LoadInt32(&s.crc32Sent))
+}
+
+// File returns the file made to entryURI, nil if none.
+func (s *Server) File(entryURI string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[entryURI]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	body, _ := ioutil.ReadAll(req.Body)
+	parts := strings.Split(req.URL.Path, "/")
+	switch parts[1] {
+	case "mkblk", "bput":
+		s.chunk(w, req, parts, body)
+	case "rs-mkfile", "mkfile":
+		// from checksums, the entry encoded by httputil.EncodeURI, else
+		// from ctxs, the entry in base64
+		bySums := req.Header.Get("Content-Type") == "application/octet-stream"
+		var entry string
+		var err error
+		if bySums {
+			entry, err = httputil.DecodeURI(parts[2])
+		} else {
+			var b []byte
+			b, err = base64.URLEncoding.DecodeString(parts[2])
+			entry = string(b)
+		}
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		var file []byte
+		s.mu.Lock()
+		if bySums {
+			for i := 0; i+20 <= len(body); i += 20 {
+				file = append(file, s.sums[string(body[i:i+20])]...)
+			}
+		} else {
+			for _, ctx := range strings.Split(string(body), ",") {
+				file = append(file, s.blocks[ctx]...)
+			}
+		}
+		s.files[entry] = file
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"hash": "fake"}`))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func (s *Server) chunk(w http.ResponseWriter, req *http.Request, parts []string, body []byte) {
+
+	ctx, offset := "", int64(0)
+	if parts[1] == "bput" {
+		ctx = parts[2]
+		offset, _ = strconv.ParseInt(parts[3], 10, 64)
+	}
+	if s.Fail != nil {
+		if code := s.Fail(ctx, offset); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+	}
+	if sent := req.Header.Get("X-Qiniu-Crc32"); sent != "" {
+		atomic.AddInt32(&s.crc32Sent, 1)
+		if sent != strconv.FormatUint(uint64(crc32.ChecksumIEEE(body)), 10) {
+			w.WriteHeader(406)
+			return
+		}
+	}
+	atomic.AddInt32(&s.chunks, 1)
+	atomic.AddInt64(&s.bytes, int64(len(body)))
+
+	s.mu.Lock()
+	data, ok := s.blocks[ctx]
+	if ctx != "" && (!ok || int64(len(data)) != offset) {
+		s.mu.Unlock()
+		w.WriteHeader(701)
+		return
+	}
+	s.seq++
+	next := "ctx" + strconv.Itoa(s.seq)
+	data = append(append([]byte(nil), data...), body...)
+	s.blocks[next] = data
+	sum := sha1.Sum(data)
+	s.sums[string(sum[:])] = data
+	s.mu.Unlock()
+
+	ret := blockRet{
+		Ctx: next, Checksum: base64.URLEncoding.EncodeToString(sum[:]),
+		Crc32: crc32.ChecksumIEEE(body), Offset: int64(len(data)),
+	}
+	if s.BadCrc32 != nil && s.BadCrc32(ctx, offset) {
+		ret.Crc32++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
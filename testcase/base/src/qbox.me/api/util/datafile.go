@@ -0,0 +1,237 @@
+package util
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"qbox.me/qetag"
+	"strconv"
+	"strings"
+)
+
+// DataFile is the data_file of a case conf, either the path of a file of
+// the data dir:
+//
+//	"data_file": "up/a.txt"
+//
+// or the spec of a payload generated on the fly, which needs no disk:
+//
+//	"data_file": {"size": "2GiB", "pattern": "random", "seed": 42}
+//
+// The patterns are random (the default), zero and seq (byte i is i%256).
+type DataFile struct {
+	Path string
+	Gen  *PayloadSpec
+
+	sha1, etag string
+}
+
+type PayloadSpec struct {
+	Size    string `json:"size"` // "1024", "4MiB", "2GiB", "5GB", ...
+	Pattern string `json:"pattern"`
+	Seed    int64  `json:"seed"`
+}
+
+func (d *DataFile) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Path); err == nil {
+		d.Gen = nil
+		return nil
+	}
+	var spec PayloadSpec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return err
+	}
+	if _, err := NewPayload(&spec); err != nil {
+		return err
+	}
+	d.Path, d.Gen = "", &spec
+	return nil
+}
+
+func (d *DataFile) String() string {
+	if d.Gen != nil {
+		return fmt.Sprintf("<%v %v seed %v>", d.Gen.Size, d.Gen.Pattern, d.Gen.Seed)
+	}
+	return d.Path
+}
+
+// Join makes a file path relative to the data dir dataPath.
+func (d *DataFile) Join(dataPath string) {
+	if d.Gen == nil {
+		d.Path = filepath.Join(dataPath, d.Path)
+	}
+}
+
+// DataReader is the content of a DataFile.
+type DataReader interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+type file struct {
+	*os.File
+	size int64
+}
+
+func (f file) Size() int64 {
+	return f.size
+}
+
+func (d *DataFile) Open() (r DataReader, err error) {
+
+	if d.Gen != nil {
+		return NewPayload(d.Gen)
+	}
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+	return file{f, fi.Size()}, nil
+}
+
+// Digest returns the sha1 (in hex) and the qetag of the content, computed
+// by reading it through once, then remembered.
+func (d *DataFile) Digest() (sha1sum, etag string, err error) {
+
+	if d.sha1 != "" {
+		return d.sha1, d.etag, nil
+	}
+	r, err := d.Open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	h1, h2 := sha1.New(), qetag.New()
+	if _, err = io.Copy(io.MultiWriter(h1, h2), io.NewSectionReader(r, 0, r.Size())); err != nil {
+		return
+	}
+	d.sha1, d.etag = hex.EncodeToString(h1.Sum(nil)), h2.Etag()
+	return d.sha1, d.etag, nil
+}
+
+// CheckEtag is util.CheckEtag for the content of d.
+func (d *DataFile) CheckEtag(hash string) error {
+	_, etag, err := d.Digest()
+	if err != nil {
+		return err
+	}
+	if etag != hash {
+		return errors.New("hash " + hash + " differs from the local qetag " + etag)
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+// Payload is a deterministic generated content: the same spec always
+// reads the same bytes, at any offset.
+type Payload struct {
+	size    int64
+	pattern string
+	seed    uint64
+}
+
+func NewPayload(spec *PayloadSpec) (p *Payload, err error) {
+
+	size, err := ParseSize(spec.Size)
+	if err != nil {
+		return
+	}
+	switch spec.Pattern {
+	case "":
+		spec.Pattern = "random"
+	case "random", "zero", "seq":
+	default:
+		return nil, errors.New("unknown payload pattern: " + spec.Pattern)
+	}
+	return &Payload{size, spec.Pattern, uint64(spec.Seed)}, nil
+}
+
+func (p *Payload) Size() int64 {
+	return p.size
+}
+
+func (p *Payload) Close() error {
+	return nil
+}
+
+// splitmix64 gives the i-th word of the random pattern.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func (p *Payload) ReadAt(b []byte, off int64) (n int, err error) {
+
+	if off >= p.size {
+		return 0, io.EOF
+	}
+	if rest := p.size - off; int64(len(b)) > rest {
+		b, err = b[:rest], io.EOF
+	}
+	switch p.pattern {
+	case "zero":
+		for i := range b {
+			b[i] = 0
+		}
+	case "seq":
+		for i := range b {
+			b[i] = byte(off + int64(i))
+		}
+	default:
+		w := uint64(off) / 8
+		word := splitmix64(p.seed ^ w)
+		for i := range b {
+			pos := uint64(off) + uint64(i)
+			if pos/8 != w {
+				w = pos / 8
+				word = splitmix64(p.seed ^ w)
+			}
+			b[i] = byte(word >> (8 * (pos % 8)))
+		}
+	}
+	return len(b), err
+}
+
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseSize parses a byte count such as "1024", "4MiB" or "5GB".
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("bad size: " + s)
+	}
+	if n > math.MaxInt64/unit {
+		return 0, errors.New("size too large: " + s + " times " + strconv.FormatInt(unit, 10))
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+
+	cases := map[string]int64{
+		"0": 0, "1024": 1024, "19B": 19, "4MiB": 4 << 20, "2GiB": 2 << 30, "5GB": 5e9, " 3 KiB": 3 << 10,
+		"8388607TiB": 8388607 << 40,
+	}
+	for s, n := range cases {
+		if got, err := ParseSize(s); err != nil || got != n {
+			t.Fatal("ParseSize:", s, got, err)
+		}
+	}
+	for _, s := range []string{"", "GiB", "-1", "1.5MiB", "2XB", "99999999TiB", "9223372036854775807KiB"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Fatal("ParseSize should fail:", s)
+		}
+	}
+}
+
+func TestDataFileUnmarshal(t *testing.T) {
+
+	var conf struct {
+		A DataFile `json:"a"`
+		B DataFile `json:"b"`
+	}
+	err := json.Unmarshal([]byte(`{"a": "up/a.txt", "b": {"size": "4MiB", "seed": 42}}`), &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.A.Path != "up/a.txt" || conf.A.Gen != nil {
+		t.Fatal("a:", conf.A)
+	}
+	if conf.B.Gen == nil || conf.B.Gen.Pattern != "random" || conf.B.Gen.Seed != 42 {
+		t.Fatal("b:", conf.B)
+	}
+	if json.Unmarshal([]byte(`{"size": "1MiB", "pattern": "nope"}`), &conf.A) == nil {
+		t.Fatal("unknown pattern should fail")
+	}
+}
+
+func TestPayload(t *testing.T) {
+
+	for _, pattern := range []string{"random", "zero", "seq"} {
+		p, err := NewPayload(&PayloadSpec{Size: "100003", Pattern: pattern, Seed: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		all := make([]byte, p.Size()+10)
+		n, err := p.ReadAt(all, 0)
+		if n != 100003 || err != io.EOF {
+			t.Fatal("ReadAt all:", pattern, n, err)
+		}
+		all = all[:n]
+
+		// any offset reads the same bytes as reading from the start
+		for _, off := range []int64{1, 7, 8, 4095, 65537, 99999} {
+			b := make([]byte, 13)
+			n, err := p.ReadAt(b, off)
+			if want := all[off:]; len(want) < 13 {
+				if n != len(want) || err != io.EOF {
+					t.Fatal("ReadAt tail:", pattern, off, n, err)
+				}
+			} else if err != nil {
+				t.Fatal("ReadAt:", pattern, off, err)
+			}
+			if !bytes.Equal(b[:n], all[off:off+int64(n)]) {
+				t.Fatal("ReadAt differs:", pattern, off)
+			}
+		}
+		if n, err := p.ReadAt(make([]byte, 1), p.Size()); n != 0 || err != io.EOF {
+			t.Fatal("ReadAt past the end:", n, err)
+		}
+	}
+
+	p1, _ := NewPayload(&PayloadSpec{Size: "64", Seed: 1})
+	p2, _ := NewPayload(&PayloadSpec{Size: "64", Seed: 2})
+	b1, b2 := make([]byte, 64), make([]byte, 64)
+	p1.ReadAt(b1, 0)
+	p2.ReadAt(b2, 0)
+	if bytes.Equal(b1, b2) {
+		t.Fatal("seeds 1 and 2 give the same payload")
+	}
+}
+
+func TestDataFileDigest(t *testing.T) {
+
+	d := DataFile{Gen: &PayloadSpec{Size: "4MiB", Pattern: "zero"}}
+	sha1sum, etag, err := d.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha1 of 4MiB of zeros, a single block
+	if sha1sum != "2bccbd2f38f15c13eb7d5a89fd9d85f595e23bc3" {
+		t.Fatal("sha1:", sha1sum)
+	}
+	if err = d.CheckEtag(etag); err != nil {
+		t.Fatal(err)
+	}
+	if d.CheckEtag("x") == nil {
+		t.Fatal("CheckEtag should fail")
+	}
+}
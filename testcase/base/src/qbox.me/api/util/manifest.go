@@ -0,0 +1,174 @@
+package util
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ManifestName is the manifest file in the data dir. Each line is the
+// size, sha1, md5 and slash-separated path of a data file:
+//
+//	19 6610c99f260be8cc3456a610556e7f5297b69f59 5c1026159ae3dcb6081089036015e9d3 up/a.txt
+const ManifestName = "MANIFEST"
+
+type DataDigest struct {
+	Size int64
+	Sha1 string
+	Md5  string
+}
+
+// Manifest maps the path of each data file to its digest.
+type Manifest map[string]DataDigest
+
+func LoadManifest(dataPath string) (m Manifest, err error) {
+
+	f, err := os.Open(filepath.Join(dataPath, ManifestName))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	m = make(Manifest)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%v:%v: bad manifest line", ManifestName, n)
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: bad size %v", ManifestName, n, fields[0])
+		}
+		m[fields[3]] = DataDigest{Size: size, Sha1: fields[1], Md5: fields[2]}
+	}
+	return m, scanner.Err()
+}
+
+// ScanData digests every file of the data dir but the manifest.
+func ScanData(dataPath string) (m Manifest, err error) {
+
+	m = make(Manifest)
+	err = filepath.Walk(dataPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dataPath, path)
+		if err != nil || rel == ManifestName {
+			return err
+		}
+		d, err := digestFile(path)
+		if err != nil {
+			return err
+		}
+		m[filepath.ToSlash(rel)] = d
+		return nil
+	})
+	return
+}
+
+func digestFile(path string) (d DataDigest, err error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h1, h2 := sha1.New(), md5.New()
+	if d.Size, err = io.Copy(io.MultiWriter(h1, h2), f); err != nil {
+		return
+	}
+	d.Sha1, d.Md5 = hex.EncodeToString(h1.Sum(nil)), hex.EncodeToString(h2.Sum(nil))
+	return
+}
+
+func (m Manifest) paths() (paths []string) {
+	for path := range m {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return
+}
+
+func (m Manifest) Write(dataPath string) error {
+
+	f, err := os.Create(filepath.Join(dataPath, ManifestName))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "# size sha1 md5 path, regenerated by `qboxtestcase data update`")
+	for _, path := range m.paths() {
+		d := m[path]
+		fmt.Fprintln(w, d.Size, d.Sha1, d.Md5, path)
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Diff returns how the files of m differ on disk, one line per file, and
+// the files on disk that are not in m.
+func (m Manifest) Diff(disk Manifest) (diffs, unlisted []string) {
+
+	for _, path := range m.paths() {
+		d, ok := disk[path]
+		switch {
+		case !ok:
+			diffs = append(diffs, path+": missing")
+		case d != m[path]:
+			diffs = append(diffs, fmt.Sprintf("%v: is %v %v %v, manifest says %v %v %v",
+				path, d.Size, d.Sha1, d.Md5, m[path].Size, m[path].Sha1, m[path].Md5))
+		}
+	}
+	for _, path := range disk.paths() {
+		if _, ok := m[path]; !ok {
+			unlisted = append(unlisted, path)
+		}
+	}
+	return
+}
+
+var manifests struct {
+	sync.Mutex
+	m map[string]Manifest
+}
+
+// DataSha1 returns the sha1 of file, relative to the data dir, from the
+// manifest. Cases use it when their conf gives no sha1.
+func DataSha1(dataPath, file string) (sha1 string, err error) {
+
+	manifests.Lock()
+	defer manifests.Unlock()
+	m, ok := manifests.m[dataPath]
+	if !ok {
+		if m, err = LoadManifest(dataPath); err != nil {
+			return
+		}
+		if manifests.m == nil {
+			manifests.m = make(map[string]Manifest)
+		}
+		manifests.m[dataPath] = m
+	}
+	d, ok := m[filepath.ToSlash(file)]
+	if !ok {
+		return "", errors.New(file + ": not in the data manifest")
+	}
+	return d.Sha1, nil
+}
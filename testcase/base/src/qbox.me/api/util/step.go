@@ -0,0 +1,62 @@
+package util
+
+import (
+	"fmt"
+	"qbox.me/httputil"
+	"time"
+)
+
+// Step is the result of one step of a case: its wall time and the HTTP
+// timing breakdown of the requests it sent through the case's recorder.
+type Step struct {
+	Name   string
+	Begin  time.Time
+	End    time.Time
+	Timing httputil.Timing
+
+	rec *httputil.Recorder
+}
+
+// NewStep begins a step. Requests recorded by rec before it are dropped.
+func NewStep(name string, rec *httputil.Recorder) *Step {
+	if rec != nil {
+		rec.Reset()
+	}
+	return &Step{Name: name, Begin: time.Now(), rec: rec}
+}
+
+// Done ends the step and returns its log line.
+func (s *Step) Done() string {
+	s.End = time.Now()
+	if s.rec != nil {
+		s.Timing = s.rec.Reset()
+	}
+	return s.String()
+}
+
+func (s *Step) Duration() time.Duration {
+	return s.End.Sub(s.Begin)
+}
+
+// Throughput is the bytes sent and received per second of wall time.
+func (s *Step) Throughput() float64 {
+	d := s.Duration().Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(s.Timing.BytesSent+s.Timing.BytesRecv) / d
+}
+
+func (s *Step) String() string {
+	return GenLogTiming(s.Name, s.Begin, s.End, s.Timing)
+}
+
+// GenLogEx followed by the timing breakdown and the throughput.
+func GenLogTiming(msg string, begin, end time.Time, t httputil.Timing) string {
+	duration := end.Sub(begin)
+	kbps := 0.0
+	if duration > 0 {
+		kbps = float64(t.BytesSent+t.BytesRecv) / 1024 / duration.Seconds()
+	}
+	return GenLogEx(msg, begin, end, duration) + fmt.Sprintf("  %v %.1fKB/s", t, kbps)
+}
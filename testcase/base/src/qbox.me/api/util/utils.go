@@ -7,18 +7,26 @@ import (
 	"strings"
 	"bytes"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	_ "code.google.com/p/go.image/tiff"
+	"qbox.me/httputil"
+	"qbox.me/qetag"
 	"qbox.me/sstore"
 	"strconv"
 	"encoding/base64"
 )
 
 
+// A case returns ErrSkipped (optionally wrapped by errors.Info) when it
+// decides not to run, e.g. the feature under test is absent in the env.
+var ErrSkipped = errors.New("skipped")
+
 // UP ==>> env.id + casename + func_name + begin + end + duration
 func GenLog(msg string, begin, end time.Time, duration time.Duration) string {
 	sBegin := begin.String()
@@ -46,7 +54,28 @@ func GenLogEx(msg string, begin, end time.Time, duration time.Duration) string {
 	return fmt.Sprintf("%-45s %-15s %-15s %15.3fs", msg, sBegin, sEnd, durationf)
 }
 
+// CheckEtag compares hash, as returned by the service for an upload of
+// localFile or by Stat, with the qetag of localFile.
+func CheckEtag(localFile, hash string) error {
+	etag, err := qetag.File(localFile)
+	if err != nil {
+		return err
+	}
+	if etag != hash {
+		return errors.New("hash " + hash + " differs from the local qetag " + etag)
+	}
+	return nil
+}
+
+// DoHttpGet gets url, limited by httputil.DefaultLimiter.
 func DoHttpGet(url string) (b *bytes.Buffer, err error) {
+	t := httputil.NewLimitTransport(http.DefaultTransport, httputil.DefaultLimiter)
+	return HttpGet(&http.Client{Transport: t}, url)
+}
+
+// HttpGet is DoHttpGet sending the request with c, e.g. the client of a
+// httputil.Recorder to trace it.
+func HttpGet(c *http.Client, url string) (b *bytes.Buffer, err error) {
 	var (
 		req  *http.Request
 		resp *http.Response
@@ -56,7 +85,7 @@ func DoHttpGet(url string) (b *bytes.Buffer, err error) {
 		return
 	}
 
-	if resp, err = http.DefaultClient.Do(req); err != nil {
+	if resp, err = c.Do(req); err != nil {
 		return
 	}
 
@@ -65,24 +94,30 @@ func DoHttpGet(url string) (b *bytes.Buffer, err error) {
 	io.Copy(b, resp.Body)
 	return
 }
-// use specified ip and host
-func DoHttpGetEx(host, ip, url string) (b *bytes.Buffer, err error) {
+// use specified ip and host: the connection to the url's host is pinned
+// to ip, e.g. "http://118.26.231.133:82", and the Host header is host.
+// The download is limited by httputil.DefaultLimiter.
+func DoHttpGetEx(host, ip, rawurl string) (b *bytes.Buffer, err error) {
 	var (
 		req  *http.Request
 		resp *http.Response
 	)
-	lastIdx := strings.LastIndex(ip, ":")
-	if lastIdx == strings.Index(ip, ":") {
-		lastIdx = len(ip)
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	to, err := url.Parse(ip)
+	if err != nil {
+		return
 	}
+	pins := map[string][]string{hostPort(u): {hostPort(to)}}
+	client := &http.Client{Transport: httputil.NewLimitTransport(httputil.NewPinTransport(pins), httputil.DefaultLimiter)}
 
-	ip2 := string([]byte(ip[7:lastIdx]))
-	url2 := replaceHostWithIP(url, host, ip2)
-	if req, err = http.NewRequest("GET", url2, nil); err != nil {
+	if req, err = http.NewRequest("GET", rawurl, nil); err != nil {
 		return
 	}
-	req.Host = host 
-	if resp, err = http.DefaultClient.Do(req); err != nil {
+	req.Host = host
+	if resp, err = client.Do(req); err != nil {
 		return
 	}
 
@@ -92,8 +127,15 @@ func DoHttpGetEx(host, ip, url string) (b *bytes.Buffer, err error) {
 	return
 }
 
-func replaceHostWithIP(url, host, ip string) string {
-	return strings.Replace(url, host, ip, 1)
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
 }
 
 func approachTo(a1 uint32, a2 uint32) bool {
@@ -75,6 +75,24 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	return t.transport.RoundTrip(req)
 }
 
+// Verify checks the "QBox key:digest" Authorization of req, as signed by
+// Transport, e.g. the callback of an upload signed by the up service.
+func Verify(req *http.Request, accessKey, secretKey string) error {
+
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 5 || auth[:5] != "QBox " {
+		return errors.New("no QBox authorization")
+	}
+	digest, err := Checksum(req, []byte(secretKey), incBody(req))
+	if err != nil {
+		return err
+	}
+	if auth[5:] != accessKey+":"+digest {
+		return errors.New("bad QBox authorization: " + auth)
+	}
+	return nil
+}
+
 func NewTransport(accessKey, secretKey string, transport http.RoundTripper) *Transport {
 	if transport == nil {
 		transport = http.DefaultTransport
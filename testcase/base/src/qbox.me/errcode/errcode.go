@@ -17,10 +17,12 @@ const (
 	BadToken         = 401 // Token 授权错误（Access Token 超时，用户修改了密码，或输入的密码错）
 	BadOAuthRequest  = 403 // Bad OAuth request (wrong consumer token, bad nonce, expired timestamp, …).
 	BadRequestMethod = 405 // Request method not expected (generally should be GET or POST).
+	BadCrc32         = 406 // 上传的数据 CRC32 校验错误
 
 	TooManyRequests  = 503 // 请求过频繁
 	ProcessPanic	 = 597 // 请求处理发生异常
 	VersionTooOld    = 598 // 客户端版本过老，支持的协议已经被废除
+	CallbackFailed   = 579 // 上传成功但是回调失败
 	FunctionFail 	 = 599 // 请求未完成
 
 	FileModified     = 608 // 文件内容被修改
@@ -44,9 +46,13 @@ var (
 	EBadToken		= Errno(BadToken)
 	EBadOAuthRequest	= Errno(BadOAuthRequest)
 	EBadRequestMethod	= Errno(BadRequestMethod)
+	EBadCrc32		= Errno(BadCrc32)
 	ETimeoutError		= Errno(TimeoutError)
 	EUnexceptedResponse = Errno(UnexceptedResponse)
 	EFunctionFail       = Errno(FunctionFail)
+	ETooManyRequests    = Errno(TooManyRequests)
+	EProcessPanic       = Errno(ProcessPanic)
+	ENetworkError       = Errno(NetworkError)
 
 	EFileModified = Errno(FileModified)
 	ENoSuchEntry  = Errno(NoSuchEntry)
@@ -60,6 +66,38 @@ var (
 
 
 
+// --------------------------------------------------------------------
+
+// 错误分类，用于报告中统一归类失败原因
+
+const (
+	ClassOK       = "ok"
+	ClassAuth     = "auth"
+	ClassNotFound = "not found"
+	ClassClient   = "client"
+	ClassServer   = "server"
+	ClassNetwork  = "network"
+	ClassInternal = "internal"
+)
+
+func Class(code int) string {
+	switch {
+	case code/100 == 2:
+		return ClassOK
+	case code == BadToken || code == BadOAuthRequest:
+		return ClassAuth
+	case code == 404 || code == NoSuchEntry || code == NoSuchBucket:
+		return ClassNotFound
+	case code == NetworkError || code == TimeoutError:
+		return ClassNetwork
+	case code == UnexceptedResponse || code/100 == 5:
+		return ClassServer
+	case code == InternalError:
+		return ClassInternal
+	}
+	return ClassClient
+}
+
 // --------------------------------------------------------------------
 
 type Errno int
@@ -75,6 +113,10 @@ func (e Errno) Error() string {
 	return "errno:" + strconv.Itoa(int(e))
 }
 
+func (e Errno) Class() string {
+	return Class(int(e))
+}
+
 func RegisterErrno(em []ErrnoMsg) {
 	for _, r := range em {
 		ErrString[r.Errno] = r.Msg
@@ -95,10 +137,12 @@ var ErrString = map[int]string{
 	BadToken: "bad token",
 	BadOAuthRequest: "bad oauth request",
 	BadRequestMethod: "bad request method",
+	BadCrc32: "crc32 of the data mismatch",
 
 	TooManyRequests: "too many requests",
 	ProcessPanic: "process panic",
 	VersionTooOld: "version too old",
+	CallbackFailed: "callback failed",
 	FunctionFail: "function fail",
 
 	NetworkError: "network error",
@@ -0,0 +1,116 @@
+package httputil
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"qbox.me/errcode"
+	"strconv"
+)
+
+// --------------------------------------------------------------------
+
+// Error is returned by every Client call which fails. It wraps an
+// errcode.Errno, so errors.Is(err, errcode.ENoSuchEntry) tells a 612, and
+// errors.As gives back the *Error, or the network error behind it.
+type Error struct {
+	Errno  errcode.Errno
+	Code   int    // HTTP status code, 0 if no response was received
+	Err    string // "error" of the response body
+	Reqid  string // X-Reqid of the response
+	Method string
+	URL    string
+	Cause  error // network or decoding error, if any
+}
+
+func (e *Error) Error() string {
+	msg := e.Method + " " + e.URL + ": "
+	if e.Code != 0 {
+		msg += strconv.Itoa(e.Code) + " "
+	}
+	switch {
+	case e.Err != "":
+		msg += e.Err
+	case e.Cause != nil:
+		msg += e.Cause.Error()
+	default:
+		msg += e.Errno.Error()
+	}
+	if e.Reqid != "" {
+		msg += " (reqid " + e.Reqid + ")"
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Cause != nil {
+		return []error{e.Errno, e.Cause}
+	}
+	return []error{e.Errno}
+}
+
+func (e *Error) Class() string {
+	return e.Errno.Class()
+}
+
+// ClassOf classifies err as one of the errcode.Class* values.
+func ClassOf(err error) string {
+	if err == nil {
+		return errcode.ClassOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Class()
+	}
+	var errno errcode.Errno
+	if errors.As(err, &errno) {
+		return errno.Class()
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return errcode.ClassNetwork
+	}
+	return errcode.ClassInternal
+}
+
+// --------------------------------------------------------------------
+
+type ErrorRet struct {
+	Error string `json:"error"`
+}
+
+func newError(resp *http.Response, errno errcode.Errno) *Error {
+	e := &Error{Errno: errno, Code: resp.StatusCode, Reqid: resp.Header.Get("X-Reqid")}
+	if req := resp.Request; req != nil {
+		e.Method, e.URL = req.Method, req.URL.String()
+	}
+	return e
+}
+
+// responseError reads the error of a non-2xx response.
+func responseError(resp *http.Response) *Error {
+	e := newError(resp, errcode.Errno(resp.StatusCode))
+	if resp.ContentLength != 0 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		var ret ErrorRet
+		if json.Unmarshal(b, &ret) == nil {
+			e.Err = ret.Error
+		}
+	}
+	return e
+}
+
+// requestError wraps the error of a request which got no response.
+func requestError(req *http.Request, err error) *Error {
+	errno := errcode.ENetworkError
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		errno = errcode.ETimeoutError
+	}
+	return &Error{Errno: errno, Method: req.Method, URL: req.URL.String(), Cause: err}
+}
+
+// --------------------------------------------------------------------
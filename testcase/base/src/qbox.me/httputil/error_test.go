@@ -0,0 +1,39 @@
+package httputil
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"qbox.me/errcode"
+	"testing"
+)
+
+func TestCallError(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Reqid", "reqid-1")
+		w.WriteHeader(errcode.NoSuchEntry)
+		io.WriteString(w, `{"error":"no such file or directory"}`)
+	}))
+	defer svr.Close()
+
+	code, err := DefaultClient.Call(nil, svr.URL+"/stat/xxx")
+	if code != errcode.NoSuchEntry || !errors.Is(err, errcode.ENoSuchEntry) {
+		t.Fatal("unexpected:", code, err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Reqid != "reqid-1" || e.Err != "no such file or directory" {
+		t.Fatal("unexpected error:", err)
+	}
+	if ClassOf(err) != errcode.ClassNotFound {
+		t.Fatal("unexpected class:", ClassOf(err))
+	}
+
+	svr.Close()
+	code, err = DefaultClient.Call(nil, svr.URL+"/stat/xxx")
+	if code != errcode.NetworkError || ClassOf(err) != errcode.ClassNetwork {
+		t.Fatal("unexpected:", code, err)
+	}
+}
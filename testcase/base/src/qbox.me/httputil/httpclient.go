@@ -18,19 +18,29 @@ type Client struct {
 }
 
 func (r *Client) doPost(url, host string, bodyType string, body io.Reader, bodyLength int64) (resp *http.Response, err error) {
+	return r.doPostHeader(url, host, nil, bodyType, body, bodyLength)
+}
+
+func (r *Client) doPostHeader(url, host string, header http.Header, bodyType string, body io.Reader, bodyLength int64) (resp *http.Response, err error) {
 	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
 		return
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Set("Content-Type", bodyType)
 	if host != "" {
 		req.Host = host
 	}
 	req.ContentLength = bodyLength
-	return r.Do(req)
+	if resp, err = r.Do(req); err != nil {
+		err = requestError(req, err)
+	}
+	return
 }
 
-func doGet(url, host string) (resp *http.Response, err error) {
+func (r *Client) doGet(url, host string) (resp *http.Response, err error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -38,7 +48,9 @@ func doGet(url, host string) (resp *http.Response, err error) {
 	if host != "" {
 		req.Host = host
 	}
-	resp, err = http.DefaultClient.Do(req)
+	if resp, err = r.Do(req); err != nil {
+		err = requestError(req, err)
+	}
 	return resp, err
 }
 
@@ -53,7 +65,7 @@ func (r *Client) CallWithFormEx(ret interface{}, url, host string, param map[str
 
 	resp, err := r.doPostForm(url, host, param)
 	if err != nil {
-		return errcode.InternalError, err
+		return codeOf(err), err
 	}
 	return callRet(ret, resp)
 }
@@ -67,7 +79,17 @@ func (r *Client) CallWithEx(ret interface{}, url, host string, bodyType string,
 
 	resp, err := r.doPost(url, host, bodyType, body, int64(bodyLength))
 	if err != nil {
-		return errcode.InternalError, err
+		return codeOf(err), err
+	}
+	return callRet(ret, resp)
+}
+
+// CallWithHeaderEx is CallWithEx sending header too.
+func (r *Client) CallWithHeaderEx(ret interface{}, url, host string, header http.Header, bodyType string, body io.Reader, bodyLength int64) (code int, err error) {
+
+	resp, err := r.doPostHeader(url, host, header, bodyType, body, bodyLength)
+	if err != nil {
+		return codeOf(err), err
 	}
 	return callRet(ret, resp)
 }
@@ -81,7 +103,7 @@ func (r *Client) CallEx(ret interface{}, url, host string) (code int, err error)
 
 	resp, err := r.doPost(url, host, "application/x-www-form-urlencoded", nil, 0)
 	if err != nil {
-		return errcode.InternalError, err
+		return codeOf(err), err
 	}
 	return callRet(ret, resp)	
 }
@@ -93,11 +115,14 @@ func (r *Client) Call(ret interface{}, url string) (code int, err error) {
 
 func (c *Client) DownloadEx(url, host string) (r io.ReadWriter, err error) {
 
-	resp, err := doGet(url, host)
-	defer resp.Body.Close()
+	resp, err := c.doGet(url, host)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, responseError(resp)
+	}
 	r = new(bytes.Buffer)
 	io.Copy(r, resp.Body)
 	return r, err
@@ -109,8 +134,13 @@ const (
 )
 
 
-type ErrorRet struct {
-	Error string "error"
+// codeOf is the code returned along with err by the Call* helpers.
+func codeOf(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return int(e.Errno)
+	}
+	return errcode.InternalError
 }
 
 func callRet(ret interface{}, resp *http.Response) (code int, err error) {
@@ -126,23 +156,14 @@ func callRet(ret interface{}, resp *http.Response) (code int, err error) {
 			io.Copy(w, resp.Body)
 			break
 		default:
-			err = json.NewDecoder(resp.Body).Decode(ret)
-			if err != nil {
-				code = errcode.UnexceptedResponse
+			if err1 := json.NewDecoder(resp.Body).Decode(ret); err1 != nil {
+				e := newError(resp, errcode.EUnexceptedResponse)
+				e.Cause = err1
+				code, err = errcode.UnexceptedResponse, e
 			}
 		}
 	} else {
-		if resp.ContentLength != 0 {
-			if ct, ok := resp.Header["Content-Type"]; ok && ct[0] == "application/json" {
-				var ret1 ErrorRet
-				json.NewDecoder(resp.Body).Decode(&ret1)
-				if ret1.Error != "" {
-					err = errors.New(ret1.Error)
-					return
-				}
-			}
-		}
-		err = errcode.Errno(code)
+		err = responseError(resp)
 	}
 	return
 }
@@ -161,7 +182,7 @@ func (r *Client) CallWithMultipartEx(ret interface{}, url, host string, param ma
 
 	resp, err := r.PostMultipart(url, host, param)
 	if err != nil {
-		return 201, err
+		return codeOf(err), err
 	}
 	return callRet(ret, resp)
 }
@@ -0,0 +1,31 @@
+package httputil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewPinTransport returns a transport which dials pins[addr] instead of
+// addr ("host:port"), trying the pinned addresses in order until one
+// connects. Since only the dial is redirected, the request url, the Host
+// header and the TLS server name all keep the original host.
+func NewPinTransport(pins map[string][]string) *http.Transport {
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+		ips, ok := pins[addr]
+		if !ok {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		for _, ip := range ips {
+			if conn, err = dialer.DialContext(ctx, network, ip); err == nil {
+				return
+			}
+		}
+		return
+	}
+	return t
+}
@@ -0,0 +1,34 @@
+package httputil
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPinTransport(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.Host)
+	}))
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	// the first ip refuses connections, the second is the server
+	pins := map[string][]string{
+		"up.example.com:80": {"127.0.0.1:1", u.Host},
+	}
+	c := &http.Client{Transport: NewPinTransport(pins)}
+	resp, err := c.Get("http://up.example.com/mkblk/4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "up.example.com" {
+		t.Fatal("Host not kept:", string(b))
+	}
+}
@@ -0,0 +1,146 @@
+package httputil
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------
+
+// Limiter is a token bucket of bytes per second, shared by all the
+// transfers it limits, e.g. the concurrent block workers of an upload. A
+// transfer of n bytes takes n tokens, waiting for the bucket to refill if
+// it is short of them. A Limiter with a parent takes the tokens of both, so
+// a per-case limit stays under the global one. A nil *Limiter is no limit.
+type Limiter struct {
+	rate   float64 // bytes per second
+	burst  float64
+	parent *Limiter
+
+	mu     sync.Mutex
+	tokens float64 // negative while transfers wait for them
+	last   time.Time
+}
+
+// DefaultLimiter is the global limit, nil for none.
+var DefaultLimiter *Limiter
+
+// limitedRead is the most read by a limited reader at once, so a transfer
+// can't take the tokens of one second in a single read.
+const limitedRead = 32 << 10
+
+// NewLimiter returns a limit of bytesPerSec under parent, or parent itself
+// if bytesPerSec <= 0. The bucket holds up to one second of tokens.
+func NewLimiter(bytesPerSec int64, parent *Limiter) *Limiter {
+
+	if bytesPerSec <= 0 {
+		return parent
+	}
+	burst := float64(bytesPerSec)
+	if burst < limitedRead {
+		burst = limitedRead
+	}
+	return &Limiter{
+		rate: float64(bytesPerSec), burst: burst, parent: parent,
+		tokens: burst, last: time.Now(),
+	}
+}
+
+// reserve takes n tokens of l and returns how long to wait for them.
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN waits for n bytes to be allowed by l and its parents.
+func (l *Limiter) WaitN(n int) {
+
+	var wait time.Duration
+	now := time.Now()
+	for ; l != nil; l = l.parent {
+		if d := l.reserve(n, now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Reader returns r limited by l, r itself if l is nil.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r, l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (n int, err error) {
+	if len(p) > limitedRead {
+		p = p[:limitedRead]
+	}
+	n, err = r.r.Read(p)
+	if n > 0 {
+		r.l.WaitN(n)
+	}
+	return
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// --------------------------------------------------------------------
+
+// NewLimitTransport returns t limiting both the request bodies it sends
+// and the response bodies it receives by l, or t itself if l is nil.
+func NewLimitTransport(t http.RoundTripper, l *Limiter) http.RoundTripper {
+	if l == nil {
+		return t
+	}
+	return &limitTransport{t, l}
+}
+
+type limitTransport struct {
+	transport http.RoundTripper
+	limiter   *Limiter
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req1 := req.Clone(req.Context())
+		req1.Body = limitedReadCloser{t.limiter.Reader(req.Body), req.Body}
+		req = req1
+	}
+	resp, err = transport.RoundTrip(req)
+	if err == nil {
+		resp.Body = limitedReadCloser{t.limiter.Reader(resp.Body), resp.Body}
+	}
+	return
+}
+
+// --------------------------------------------------------------------
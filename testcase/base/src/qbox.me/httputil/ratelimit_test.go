@@ -0,0 +1,70 @@
+package httputil
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+
+	// 2 * 128K at 128K a second, the first 128K from the burst: 1s
+	l := NewLimiter(128<<10, nil)
+	begin := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 128<<10))))
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(begin); d < 800*time.Millisecond || d > 2*time.Second {
+		t.Fatal("shared limit took:", d)
+	}
+
+	// a child is no faster than its parent
+	parent := NewLimiter(64<<10, nil)
+	child := NewLimiter(1<<20, parent)
+	begin = time.Now()
+	io.Copy(io.Discard, child.Reader(bytes.NewReader(make([]byte, 96<<10))))
+	if d := time.Since(begin); d < 400*time.Millisecond {
+		t.Fatal("child limit took:", d)
+	}
+
+	if NewLimiter(0, parent) != parent || NewLimiter(0, nil) != nil {
+		t.Fatal("no limit should be the parent")
+	}
+	var none *Limiter
+	if r := bytes.NewReader(nil); none.Reader(r) != io.Reader(r) {
+		t.Fatal("nil limiter should not wrap")
+	}
+	none.WaitN(1 << 30)
+}
+
+func TestLimitTransport(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		w.Write(b)
+	}))
+	defer svr.Close()
+
+	// 96K up and 96K down, the first 64K from the burst: 2s
+	c := &http.Client{Transport: NewLimitTransport(nil, NewLimiter(64<<10, nil))}
+	begin := time.Now()
+	resp, err := c.Post(svr.URL, "application/octet-stream", bytes.NewReader(make([]byte, 96<<10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if d := time.Since(begin); n != 96<<10 || d < 1600*time.Millisecond {
+		t.Fatal("limited echo:", n, d)
+	}
+}
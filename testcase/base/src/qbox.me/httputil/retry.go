@@ -0,0 +1,150 @@
+package httputil
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"qbox.me/errcode"
+	"time"
+)
+
+// --------------------------------------------------------------------
+
+// RetryPolicy is the exponential backoff with jitter used by Retry. Zero
+// fields take the value of DefaultRetryPolicy.
+type RetryPolicy struct {
+	MaxAttempts int `json:"max_attempts"` // the first one included, 1 to disable
+	BaseDelay   int `json:"base_delay"`   // ms, doubled after each attempt
+	MaxDelay    int `json:"max_delay"`    // ms
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 100, MaxDelay: 5000}
+
+func (p *RetryPolicy) attempts() int {
+	if p == nil || p.MaxAttempts == 0 {
+		return DefaultRetryPolicy.MaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+// Delay returns the backoff to wait before attempt n+1, n >= 1: a random
+// duration in [d/2, d) with d = min(BaseDelay << (n-1), MaxDelay).
+func (p *RetryPolicy) Delay(n int) time.Duration {
+	base, max := DefaultRetryPolicy.BaseDelay, DefaultRetryPolicy.MaxDelay
+	if p != nil && p.BaseDelay > 0 {
+		base = p.BaseDelay
+	}
+	if p != nil && p.MaxDelay > 0 {
+		max = p.MaxDelay
+	}
+	d := time.Duration(base) * time.Millisecond
+	for i := 1; i < n && d < time.Duration(max)*time.Millisecond; i++ {
+		d *= 2
+	}
+	if d > time.Duration(max)*time.Millisecond {
+		d = time.Duration(max) * time.Millisecond
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// Retryable tells whether a request with method which failed with code and
+// err may be sent again. 503 (the request was refused) and 599 (it was not
+// completed) are always retried, other server errors only for idempotent
+// methods. A network error is retried for idempotent methods, or when the
+// connection was never established.
+func Retryable(method string, code int, err error) bool {
+
+	switch code {
+	case errcode.TooManyRequests, errcode.FunctionFail:
+		return true
+	}
+	switch errcode.Class(code) {
+	case errcode.ClassServer:
+		return idempotent(method)
+	case errcode.ClassNetwork:
+		var oe *net.OpError
+		return idempotent(method) || (errors.As(err, &oe) && oe.Op == "dial")
+	}
+	return false
+}
+
+// --------------------------------------------------------------------
+
+type attemptKey struct{}
+
+// Attempt returns which attempt of Retry req is, 1 for the first one.
+func Attempt(req *http.Request) int {
+	if n, ok := req.Context().Value(attemptKey{}).(int); ok {
+		return n
+	}
+	return 1
+}
+
+// Retry is a http.RoundTripper sending the requests through Transport
+// again, after a backoff, while they fail with a Retryable error. Requests
+// whose body can't be rewound (no GetBody) are sent once.
+type Retry struct {
+	Transport http.RoundTripper // http.DefaultTransport if nil
+	Policy    *RetryPolicy      // DefaultRetryPolicy if nil
+}
+
+func NewRetry(t http.RoundTripper, p *RetryPolicy) *Retry {
+	return &Retry{Transport: t, Policy: p}
+}
+
+func (r *Retry) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	attempts := r.Policy.attempts()
+	if req.Body != nil && req.GetBody == nil {
+		attempts = 1
+	}
+
+	for n := 1; ; n++ {
+		req1 := req
+		if n > 1 {
+			req1 = req.Clone(context.WithValue(req.Context(), attemptKey{}, n))
+			if req.GetBody != nil {
+				if req1.Body, err = req.GetBody(); err != nil {
+					return
+				}
+			}
+		}
+		resp, err = transport.RoundTrip(req1)
+
+		code := 0
+		switch {
+		case err != nil:
+			code = int(requestError(req1, err).Errno)
+		default:
+			code = resp.StatusCode
+		}
+		if n >= attempts || !Retryable(req.Method, code, err) {
+			return
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(r.Policy.Delay(n)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// --------------------------------------------------------------------
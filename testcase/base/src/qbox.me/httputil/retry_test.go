@@ -0,0 +1,69 @@
+package httputil
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"qbox.me/errcode"
+	"strings"
+	"testing"
+)
+
+func TestRetry(t *testing.T) {
+
+	n := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n++
+		b, _ := io.ReadAll(req.Body)
+		if n < 3 {
+			w.WriteHeader(errcode.TooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"body":"`+string(b)+`"}`)
+	}))
+	defer svr.Close()
+
+	rec := NewRecorder(nil)
+	policy := &RetryPolicy{MaxAttempts: 3, BaseDelay: 1, MaxDelay: 2}
+	c := Client{&http.Client{Transport: NewRetry(rec, policy)}}
+
+	var ret struct{ Body string }
+	_, err := c.CallWithForm(&ret, svr.URL+"/stat", map[string][]string{"a": {"1"}})
+	if err != nil || ret.Body != "a=1" || n != 3 {
+		t.Fatal("unexpected:", err, ret, n)
+	}
+	if tm := rec.Reset(); tm.Requests != 3 || tm.Retries != 2 {
+		t.Fatal("unexpected timing:", tm)
+	}
+
+	// a body which can't be rewound is sent once
+	n = 0
+	_, err = c.CallWith(&ret, svr.URL+"/stat", "text/plain", io.MultiReader(strings.NewReader("x")), 1)
+	if !errors.Is(err, errcode.ETooManyRequests) || n != 1 {
+		t.Fatal("unexpected:", err, n)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+
+	cases := []struct {
+		method string
+		code   int
+		ok     bool
+	}{
+		{"POST", errcode.TooManyRequests, true},
+		{"POST", errcode.FunctionFail, true},
+		{"POST", 500, false},
+		{"GET", 500, true},
+		{"GET", errcode.NetworkError, true},
+		{"POST", errcode.NetworkError, false},
+		{"GET", errcode.NoSuchEntry, false},
+	}
+	for _, c := range cases {
+		if Retryable(c.method, c.code, nil) != c.ok {
+			t.Fatal("Retryable", c.method, c.code, "!=", c.ok)
+		}
+	}
+}
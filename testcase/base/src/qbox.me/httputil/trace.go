@@ -0,0 +1,188 @@
+package httputil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------
+
+// Timing is the breakdown of the requests sent through a Recorder. When
+// several requests are recorded, the durations and byte counts are summed.
+type Timing struct {
+	Requests  int
+	Retries   int // requests which were a Retry of a failed one
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	TTFB      time.Duration // request fully written -> first response byte
+	Transfer  time.Duration // first response byte -> body EOF or close
+	BytesSent int64
+	BytesRecv int64
+}
+
+func (t *Timing) Add(t1 Timing) {
+	t.Requests += t1.Requests
+	t.Retries += t1.Retries
+	t.DNS += t1.DNS
+	t.Connect += t1.Connect
+	t.TLS += t1.TLS
+	t.TTFB += t1.TTFB
+	t.Transfer += t1.Transfer
+	t.BytesSent += t1.BytesSent
+	t.BytesRecv += t1.BytesRecv
+}
+
+func (t Timing) String() string {
+	return fmt.Sprintf("req %d retry %d dns %.3fs conn %.3fs tls %.3fs ttfb %.3fs xfer %.3fs sent %dB recv %dB",
+		t.Requests, t.Retries, t.DNS.Seconds(), t.Connect.Seconds(), t.TLS.Seconds(),
+		t.TTFB.Seconds(), t.Transfer.Seconds(), t.BytesSent, t.BytesRecv)
+}
+
+// --------------------------------------------------------------------
+
+// Recorder is a http.RoundTripper tracing every request it sends with
+// httptrace, and accumulating the timings until the next Reset.
+type Recorder struct {
+	Transport http.RoundTripper // http.DefaultTransport if nil
+
+	mu     sync.Mutex
+	timing Timing
+}
+
+func NewRecorder(t http.RoundTripper) *Recorder {
+	return &Recorder{Transport: t}
+}
+
+// Client returns a http.Client sending its requests through r.
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+// Reset returns the timing accumulated so far and starts a new one.
+func (r *Recorder) Reset() (t Timing) {
+	r.mu.Lock()
+	t, r.timing = r.timing, Timing{}
+	r.mu.Unlock()
+	return
+}
+
+func (r *Recorder) add(t Timing) {
+	r.mu.Lock()
+	r.timing.Add(t)
+	r.mu.Unlock()
+}
+
+// reqTrace is the timing of one request, set by the httptrace callbacks
+// which the transport calls from its own goroutines.
+type reqTrace struct {
+	mu                                   sync.Mutex
+	t                                    Timing
+	dnsStart, connStart, tlsStart, wrote time.Time
+}
+
+// set calls f on the trace under its lock.
+func (tr *reqTrace) set(f func(tr *reqTrace)) {
+	tr.mu.Lock()
+	f(tr)
+	tr.mu.Unlock()
+}
+
+// snapshot returns the timing so far, the callbacks of a request may still
+// run once its response arrived.
+func (tr *reqTrace) snapshot() Timing {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.t
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+
+	tr := &reqTrace{t: Timing{Requests: 1}}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			tr.set(func(tr *reqTrace) { tr.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			tr.set(func(tr *reqTrace) { tr.t.DNS = time.Since(tr.dnsStart) })
+		},
+		ConnectStart: func(network, addr string) {
+			tr.set(func(tr *reqTrace) { tr.connStart = time.Now() })
+		},
+		ConnectDone: func(network, addr string, err error) {
+			tr.set(func(tr *reqTrace) { tr.t.Connect = time.Since(tr.connStart) })
+		},
+		TLSHandshakeStart: func() {
+			tr.set(func(tr *reqTrace) { tr.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			tr.set(func(tr *reqTrace) { tr.t.TLS = time.Since(tr.tlsStart) })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			tr.set(func(tr *reqTrace) { tr.wrote = time.Now() })
+		},
+		GotFirstResponseByte: func() {
+			tr.set(func(tr *reqTrace) { tr.t.TTFB = time.Since(tr.wrote) })
+		},
+	}
+	if Attempt(req) > 1 {
+		tr.t.Retries = 1
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	if req.ContentLength > 0 {
+		tr.t.BytesSent = req.ContentLength
+	}
+
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		r.add(tr.snapshot())
+		return
+	}
+	resp.Body = &tracedBody{ReadCloser: resp.Body, r: r, t: tr.snapshot(), begin: time.Now()}
+	return
+}
+
+// tracedBody measures the body transfer and hands the completed timing
+// to the recorder on EOF or Close, whichever comes first.
+type tracedBody struct {
+	io.ReadCloser
+	r     *Recorder
+	t     Timing
+	recv  int64 // atomic, Close may be called while reading
+	begin time.Time
+	once  sync.Once
+}
+
+func (b *tracedBody) done() {
+	b.once.Do(func() {
+		b.t.Transfer = time.Since(b.begin)
+		b.t.BytesRecv = atomic.LoadInt64(&b.recv)
+		b.r.add(b.t)
+	})
+}
+
+func (b *tracedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.recv, int64(n))
+	if err == io.EOF {
+		b.done()
+	}
+	return
+}
+
+func (b *tracedBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+// --------------------------------------------------------------------
@@ -0,0 +1,41 @@
+package httputil
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(ioutil.Discard, req.Body)
+		io.WriteString(w, "hello world")
+	}))
+	defer svr.Close()
+
+	rec := NewRecorder(nil)
+	c := rec.Client()
+	for i := 0; i < 2; i++ {
+		resp, err := c.Post(svr.URL, "text/plain", strings.NewReader("1234"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	tm := rec.Reset()
+	if tm.Requests != 2 || tm.BytesSent != 8 || tm.BytesRecv != 22 {
+		t.Fatal("unexpected timing:", tm)
+	}
+	if tm.Connect <= 0 {
+		t.Fatal("connect not traced:", tm)
+	}
+	if tm = rec.Reset(); tm.Requests != 0 {
+		t.Fatal("Reset does not clear timing:", tm)
+	}
+}
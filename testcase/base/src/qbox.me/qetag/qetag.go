@@ -0,0 +1,84 @@
+// Package qetag computes the content hash the service returns as the
+// "hash" of an entry. The content is split in 4MB blocks, as by
+// up.Service.BlockCount. The hash of a content of at most one block is
+// 0x16 followed by its sha1, else 0x96 followed by the sha1 of the sha1s
+// of its blocks, encoded in url-safe base64.
+package qetag
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"hash"
+	"io"
+	"os"
+)
+
+const (
+	BlockBits = 22
+	BlockSize = 1 << BlockBits
+)
+
+// Hash computes the qetag of what is written to it.
+type Hash struct {
+	block  hash.Hash // sha1 of the current block
+	n      int       // bytes written to the current block
+	blocks []byte    // sha1s of the complete blocks
+}
+
+func New() *Hash {
+	return &Hash{block: sha1.New()}
+}
+
+func (h *Hash) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if h.n == BlockSize {
+			h.blocks = h.block.Sum(h.blocks)
+			h.block.Reset()
+			h.n = 0
+		}
+		m := BlockSize - h.n
+		if m > len(p) {
+			m = len(p)
+		}
+		h.block.Write(p[:m])
+		h.n += m
+		n += m
+		p = p[m:]
+	}
+	return
+}
+
+// Sum returns the raw qetag, 21 bytes.
+func (h *Hash) Sum() []byte {
+	if len(h.blocks) == 0 {
+		return h.block.Sum([]byte{0x16})
+	}
+	s := sha1.New()
+	s.Write(h.blocks)
+	s.Write(h.block.Sum(nil))
+	return s.Sum([]byte{0x96})
+}
+
+// Etag returns the qetag as the service encodes it.
+func (h *Hash) Etag() string {
+	return base64.URLEncoding.EncodeToString(h.Sum())
+}
+
+// Reader returns the qetag of what is read from r until EOF.
+func Reader(r io.Reader) (etag string, err error) {
+	h := New()
+	if _, err = io.Copy(h, r); err != nil {
+		return
+	}
+	return h.Etag(), nil
+}
+
+// File returns the qetag of the file name.
+func File(name string) (etag string, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return Reader(f)
+}
@@ -0,0 +1,52 @@
+package qetag
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+)
+
+func TestEtag(t *testing.T) {
+
+	if etag, _ := Reader(bytes.NewReader(nil)); etag != "Fto5o-5ea0sNMlW_75VgGJCv2AcJ" {
+		t.Fatal("empty:", etag)
+	}
+
+	data := make([]byte, 2*BlockSize+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, size := range []int{1, BlockSize, BlockSize + 1, len(data)} {
+		var want []byte
+		if size <= BlockSize {
+			s := sha1.Sum(data[:size])
+			want = append([]byte{0x16}, s[:]...)
+		} else {
+			var sums []byte
+			for off := 0; off < size; off += BlockSize {
+				end := off + BlockSize
+				if end > size {
+					end = size
+				}
+				s := sha1.Sum(data[off:end])
+				sums = append(sums, s[:]...)
+			}
+			s := sha1.Sum(sums)
+			want = append([]byte{0x96}, s[:]...)
+		}
+
+		// written in odd pieces, across the block boundaries
+		h := New()
+		for off := 0; off < size; off += 999983 {
+			end := off + 999983
+			if end > size {
+				end = size
+			}
+			h.Write(data[off:end])
+		}
+		if etag := h.Etag(); etag != base64.URLEncoding.EncodeToString(want) {
+			t.Fatal("size", size, "etag", etag)
+		}
+	}
+}
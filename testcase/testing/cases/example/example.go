@@ -2,6 +2,7 @@ package example
 
 import (
 	"errors"
+	"qbox.me/api"
 	"qbox.us/cc/config"
 )
 
@@ -14,7 +15,7 @@ type Example struct {
 	conf *ExampleConf
 }
 
-func (p *Example) Init(conf, env, path string) (err error) {
+func (p *Example) Init(conf string, env *api.Env, path string) (err error) {
 
 	if err = config.LoadEx(&p.conf, conf); err != nil {
 		return
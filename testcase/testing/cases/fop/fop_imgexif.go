@@ -13,6 +13,7 @@ import (
 	"qbox.me/api/util"
 	"qbox.me/auth/digest"
 	"qbox.me/auth/uptoken"
+	"qbox.me/httputil"
 	"qbox.us/cc/config"
 	"time"
 )
@@ -28,6 +29,7 @@ type FopImgExif struct {
 	UploadImg string `json:"img_data"`
 	SrcExif   ImgExif
 	Env       api.Env
+	rec       *httputil.Recorder
 }
 
 type ValueTypePair struct {
@@ -78,28 +80,31 @@ type ImgExif struct {
 	YResolution             ValueTypePair `json:"YResolution"`
 }
 
-func (self *FopImgExif) Init(conf, env, path string) (err error) {
+func (self *FopImgExif) Init(conf string, env *api.Env, path string) (err error) {
 
 	if err = config.LoadEx(self, conf); err != nil {
 		return
 	}
-	if err = config.LoadEx(&self.Env, env); err != nil {
-		return
-	}
+	self.Env = *env
 	if err = config.LoadEx(&self.SrcExif, conf); err != nil {
 		return
 	}
 	self.UploadImg = filepath.Join(path, self.UploadImg)
+	self.rec = httputil.NewRecorder(self.Env.Transport())
 	//self.SrcExif = filepath.Join(path, self.SrcExif)
 	return
 }
 
+func (self *FopImgExif) Services() []string {
+	return []string{"up", "rs", "io", "fopd"}
+}
+
 // upload the file and get the download url 
 func (self *FopImgExif) doTestGetImgUrl() (url string, err error) {
 	entry := self.BucketName + ":" + self.Key
 
-	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, nil)
-	rsservice, err := rs.New(self.Env.Hosts, self.Env.Ips, dt)
+	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	rsservice, err := rs.New(self.Env.Hosts, self.Env.URLs(), dt)
 	if err != nil {
 		return
 	}
@@ -109,14 +114,14 @@ func (self *FopImgExif) doTestGetImgUrl() (url string, err error) {
 	}
 	authPolicy.Deadline += uint32(time.Now().Unix())
 	token := uptoken.MakeAuthTokenString(self.Env.AccessKey, self.Env.SecretKey, authPolicy)
-	_, code, err := rsservice.Upload(entry, self.UploadImg, "", "", "", token)
+	_, _, err = rsservice.Upload(entry, self.UploadImg, "", "", "", token)
 
-	if err != nil || code != 200 {
+	if err != nil {
 		return
 	}
 
-	getRet, code, err := rsservice.Get(entry, "", "", 3600)
-	if err != nil || code != 200 {
+	getRet, _, err := rsservice.Get(entry, "", "", 3600)
+	if err != nil {
 		return
 	}
 
@@ -125,20 +130,18 @@ func (self *FopImgExif) doTestGetImgUrl() (url string, err error) {
 }
 
 func (self *FopImgExif) doTestImgExif(downloadUrl string) (msg string, err error) {
-	begin := time.Now()
+	step := util.NewStep("Fp    "+self.Env.Id+"_"+self.Name+"_doTestImgOp", self.rec)
 	url := downloadUrl + "exif"
-	netBuf, err := util.DoHttpGet(url)
+	netBuf, err := util.HttpGet(self.rec.Client(), url)
+	msg = step.Done()
+	if err != nil {
+		return
+	}
 	var TargetExif ImgExif
 	json.Unmarshal(netBuf.Bytes(), &TargetExif)
 	if self.SrcExif != TargetExif {
 		err = errors.New("Umatched Exif!")
 	}
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("Fp    "+self.Env.Id+"_"+self.Name+"_doTestImgOp", begin, end, duration)
-	if err != nil {
-		return
-	}
 	return
 }
 
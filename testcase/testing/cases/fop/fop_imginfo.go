@@ -15,6 +15,7 @@ import (
 	"qbox.me/api/util"
 	da "qbox.me/auth/digest"
 	"qbox.me/auth/uptoken"
+	"qbox.me/httputil"
 )
 
 type FopImgInfo struct {
@@ -33,6 +34,7 @@ type FopImgInfo struct {
 	FopdLoger     *log.Logger
 
 	Env api.Env
+	rec *httputil.Recorder
 }
 
 type ImageInfo struct {
@@ -42,24 +44,27 @@ type ImageInfo struct {
 	ColorModel string `json:"colorModel"`
 }
 
-func (self *FopImgInfo) Init(conf, env, path string) (err error) {
+func (self *FopImgInfo) Init(conf string, env *api.Env, path string) (err error) {
 
 	if err = config.LoadEx(self, conf); err != nil {
 		return
 	}
-	if err = config.LoadEx(&self.Env, env); err != nil {
-		return
-	}
+	self.Env = *env
 	self.SrcImg = filepath.Join(path, self.SrcImg)
+	self.rec = httputil.NewRecorder(self.Env.Transport())
 	return
 }
 
+func (self *FopImgInfo) Services() []string {
+	return []string{"up", "rs", "io", "fopd"}
+}
+
 // upload the file and get the download url 
 func (self *FopImgInfo) doTestGetImgUrl() (url string, err error) {
 	entry := self.BucketName + ":" + self.Key
 
-	dt := da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, nil)
-	rsservice, err := rs.New(self.Env.Hosts, self.Env.Ips, dt)
+	dt := da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	rsservice, err := rs.New(self.Env.Hosts, self.Env.URLs(), dt)
 	if err != nil {
 		return
 	}
@@ -69,14 +74,14 @@ func (self *FopImgInfo) doTestGetImgUrl() (url string, err error) {
 	}
 	authPolicy.Deadline += uint32(time.Now().Unix())
 	token := uptoken.MakeAuthTokenString(self.Env.AccessKey, self.Env.SecretKey, authPolicy)
-	_, code, err := rsservice.Upload(entry, self.SrcImg, "", "", "", token)
+	_, _, err = rsservice.Upload(entry, self.SrcImg, "", "", "", token)
 
-	if err != nil || code != 200 {
+	if err != nil {
 		return
 	}
 
-	getRet, code, err := rsservice.Get(entry, "", "", 3600)
-	if err != nil || code != 200 {
+	getRet, _, err := rsservice.Get(entry, "", "", 3600)
+	if err != nil {
 		return
 	}
 
@@ -85,12 +90,10 @@ func (self *FopImgInfo) doTestGetImgUrl() (url string, err error) {
 }
 
 func (self *FopImgInfo) doTestGetImgInfo(downloadUrl string) (msg string, err error) {
-	begin := time.Now()
+	step := util.NewStep("Fp    "+self.Env.Id+"_"+self.Name+"_doTestGetImgInfo", self.rec)
 	url := downloadUrl + "imageInfo"
-	netBuf, err := util.DoHttpGet(url)
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("Fp    "+self.Env.Id+"_"+self.Name+"_doTestGetImgInfo", begin, end, duration)
+	netBuf, err := util.HttpGet(self.rec.Client(), url)
+	msg = step.Done()
 	if err != nil {
 		return
 	}
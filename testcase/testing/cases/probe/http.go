@@ -0,0 +1,247 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"qbox.us/cc/config"
+	"qbox.us/errors"
+	da "qbox.me/auth/digest"
+	"qbox.me/auth/uptoken"
+	"qbox.me/api"
+	"qbox.me/api/util"
+	"qbox.me/httputil"
+)
+
+// HttpExpect is the assertions on the response of a HttpProbe. Headers are
+// regexps, Json maps dotted paths into the body ("items.0.key") to their
+// values.
+type HttpExpect struct {
+	Status  int                    `json:"status"` // 200 if 0
+	Headers map[string]string      `json:"headers"`
+	Sha1    string                 `json:"body_sha1"`
+	Json    map[string]interface{} `json:"json"`
+	Image   bool                   `json:"image"` // the body decodes as an image
+}
+
+// HttpProbe sends one request and checks the response. Url, Host, the
+// header values and Body may refer to ${host.<svc>} and ${ip.<svc>} (the
+// env host and first ip of a service), ${url.<svc>} (see api.Env.URL),
+// ${fopd}, ${env} and ${run}, a random string regenerated by each run.
+// Requests to an ${url.<svc>} are pinned to the env ips.
+type HttpProbe struct {
+	Name        string            `json:"name"`
+	Method      string            `json:"method"` // GET if ""
+	Url         string            `json:"url"`
+	Host        string            `json:"host"`
+	Headers     map[string]string `json:"headers"`
+	Auth        string            `json:"auth"`  // "", "digest" or "uptoken"
+	Scope       string            `json:"scope"` // of the uptoken
+	Body        string            `json:"body"`
+	BodyFile    string            `json:"body_file"` // in the data dir, instead of Body
+	ContentType string            `json:"content_type"`
+	Expect      HttpExpect        `json:"expect"`
+
+	vars   map[string]string
+	client *http.Client
+	Env    api.Env
+	rec    *httputil.Recorder
+}
+
+func (self *HttpProbe) Init(conf string, env *api.Env, path string) (err error) {
+
+	if err = config.LoadEx(self, conf); err != nil {
+		return
+	}
+	self.Env = *env
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	if self.BodyFile != "" {
+		self.BodyFile = filepath.Join(path, self.BodyFile)
+	}
+	if self.Method == "" {
+		self.Method = "GET"
+	}
+	if self.Expect.Status == 0 {
+		self.Expect.Status = 200
+	}
+
+	var t http.RoundTripper = self.Env.Retrying(self.rec)
+	switch self.Auth {
+	case "":
+	case "digest":
+		t = da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, t)
+	case "uptoken":
+		policy := &uptoken.AuthPolicy{Scope: self.Scope, Deadline: uint32(time.Now().Unix()) + uptoken.EXPIRES_TIME}
+		t = uptoken.NewTransport(uptoken.MakeAuthTokenString(self.Env.AccessKey, self.Env.SecretKey, policy), t)
+	default:
+		return errors.Info(errors.New("unknown auth"), conf, self.Auth)
+	}
+	self.client = &http.Client{Transport: t}
+	return
+}
+
+var svcRef = regexp.MustCompile(`\$\{(?:host|ip|url)\.(\w+)\}`)
+
+// Services are those referred to by Url and Host.
+func (self *HttpProbe) Services() (svcs []string) {
+	for _, m := range svcRef.FindAllStringSubmatch(self.Url+self.Host, -1) {
+		svcs = append(svcs, m[1])
+	}
+	if strings.Contains(self.Url, "${fopd}") {
+		svcs = append(svcs, "fopd")
+	}
+	return
+}
+
+func (self *HttpProbe) expand(s string) string {
+	return os.Expand(s, func(name string) string { return self.vars[name] })
+}
+
+func (self *HttpProbe) doRequest() (resp *http.Response, body []byte, err error) {
+
+	var r io.Reader
+	switch {
+	case self.BodyFile != "":
+		var b []byte
+		if b, err = ioutil.ReadFile(self.BodyFile); err != nil {
+			return
+		}
+		r = bytes.NewReader(b)
+	case self.Body != "":
+		r = strings.NewReader(self.expand(self.Body))
+	}
+	req, err := http.NewRequest(self.Method, self.expand(self.Url), r)
+	if err != nil {
+		return
+	}
+	if self.Host != "" {
+		req.Host = self.expand(self.Host)
+	}
+	if self.ContentType != "" {
+		req.Header.Set("Content-Type", self.ContentType)
+	}
+	for k, v := range self.Headers {
+		req.Header.Set(k, self.expand(v))
+	}
+	if resp, err = self.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+func (self *HttpProbe) check(resp *http.Response, body []byte) error {
+
+	e := &self.Expect
+	if resp.StatusCode != e.Status {
+		return errors.Info(errors.New("unexpected status"), resp.StatusCode, "expected", e.Status)
+	}
+	for k, re := range e.Headers {
+		r, err := regexp.Compile(self.expand(re))
+		if err != nil {
+			return errors.Info(err, "bad header regexp", k)
+		}
+		if v := resp.Header.Get(k); !r.MatchString(v) {
+			return errors.Info(errors.New("unexpected header"), k, v, "expected", re)
+		}
+	}
+	if e.Sha1 != "" {
+		h := sha1.Sum(body)
+		if sum := hex.EncodeToString(h[:]); sum != self.expand(e.Sha1) {
+			return errors.Info(errors.New("unexpected body sha1"), sum, "expected", e.Sha1)
+		}
+	}
+	if len(e.Json) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return errors.Info(err, "body is not json")
+		}
+		for path, want := range e.Json {
+			got, ok := jsonPath(v, path)
+			if !ok {
+				return errors.Info(errors.New("no such json field"), path)
+			}
+			if fmt.Sprint(got) != self.expand(fmt.Sprint(want)) {
+				return errors.Info(errors.New("unexpected json field"), path, got, "expected", want)
+			}
+		}
+	}
+	if e.Image {
+		if _, format, err := image.Decode(bytes.NewReader(body)); err != nil {
+			return errors.Info(err, "body is not an image", format)
+		}
+	}
+	return nil
+}
+
+// jsonPath returns the value at the dotted path in v, the elements of an
+// array being indexed by number.
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	for _, k := range strings.Split(path, ".") {
+		switch v1 := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = v1[k]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(v1) {
+				return nil, false
+			}
+			v = v1[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (self *HttpProbe) Test() (msg string, err error) {
+
+	self.vars = map[string]string{
+		"env":  self.Env.Id,
+		"fopd": self.Env.Fopd,
+		"run":  strconv.FormatInt(rand.Int63(), 36),
+	}
+	for svc, host := range self.Env.Hosts {
+		self.vars["host."+svc] = host
+	}
+	for svc, ips := range self.Env.Ips {
+		if len(ips) > 0 {
+			self.vars["ip."+svc] = ips[0]
+		}
+		self.vars["url."+svc] = self.Env.URL(svc)
+	}
+
+	step := util.NewStep("HTTP  "+self.Env.Id+"_"+self.Name+"_"+self.Method, self.rec)
+	resp, body, err := self.doRequest()
+	log1 := step.Done()
+	if err == nil {
+		err = self.check(resp, body)
+	}
+	if err != nil {
+		err = errors.Info(err, self.Method, self.expand(self.Url))
+		msg = fmt.Sprintln(log1, err)
+		return
+	}
+	msg = fmt.Sprintln(log1, " ok")
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"qbox.us/errors"
 	"qbox.me/api"	
 	"qbox.me/api/pub"
+	"qbox.me/api/util"
 	"qbox.me/httputil"
 	da "qbox.me/auth/digest"
 )
@@ -19,20 +20,19 @@ type PubImage struct {
 
 	Pubcli *pub.Service
 	Env api.Env
+	rec *httputil.Recorder
 }
 
-func (p *PubImage) Init(conf, env, path string) (err error) {
+func (p *PubImage) Init(conf string, env *api.Env, path string) (err error) {
 
 	if err = config.LoadEx(p, conf); err != nil {
 		err = errors.Info(err, "pub_image load conf failed", conf)
 		return
 	}
-	if err = config.LoadEx(&p.Env, env); err != nil {
-		err = errors.Info(err, "pub_image load env failed", env)
-		return
-	}
-	dt := da.NewTransport(p.Env.AccessKey, p.Env.SecretKey, nil)
-	p.Pubcli, err = pub.New(p.Env.Hosts["pu"], p.Env.Ips["pu"], dt)
+	p.Env = *env
+	p.rec = httputil.NewRecorder(p.Env.Transport())
+	dt := da.NewTransport(p.Env.AccessKey, p.Env.SecretKey, p.Env.Retrying(p.rec))
+	p.Pubcli, err = pub.New(p.Env.Hosts["pu"], p.Env.URL("pu"), dt)
 	if err != nil {
 		err = errors.Info(err, "pub_image init failed")
 		return
@@ -40,19 +40,22 @@ func (p *PubImage) Init(conf, env, path string) (err error) {
 	return
 }
 
+func (p *PubImage) Services() []string {
+	return []string{"pu", "io"}
+}
+
 func (p *PubImage) doTestImage() (msg string, err error) {
 
+	step := util.NewStep("Pb    "+p.Env.Id+"_"+p.Name+"_doTestImage", p.rec)
 	from := []string{p.FromDomain}
-	code, err := p.Pubcli.Image(p.Bucket, from, p.SrcHost, 0)
-	if err != nil || code/100 != 2 {
-		if err == nil {
-			err = errors.New("doTestImage failed")
-		} 
-		err = errors.Info(err, code, p.SrcHost, p.FromDomain)
+	_, err = p.Pubcli.Image(p.Bucket, from, p.SrcHost, 0)
+	if err != nil {
+		err = errors.Info(err, p.SrcHost, p.FromDomain)
 		return
 	}
 	url := "http://" + p.Env.Hosts["io"] + "/" + p.SrcKey
-	_, err = httputil.DownloadEx(url, p.FromDomain)
+	_, err = (&httputil.Client{Client: p.rec.Client()}).DownloadEx(url, p.FromDomain)
+	msg = step.Done()
 	if err != nil {
 		err = errors.Info(err, "doTestImage failed", url)
 		return
@@ -62,12 +65,11 @@ func (p *PubImage) doTestImage() (msg string, err error) {
 
 func (p *PubImage) doTestUnimage() (msg string, err error) {
 
-	code, err := p.Pubcli.Unimage(p.Bucket)
-	if err != nil || code/100 != 2 {
-		if err == nil {
-			err = errors.New("doTestUnimage failed")
-		}
-		err = errors.Info(err, code, p.Bucket)
+	step := util.NewStep("Pb    "+p.Env.Id+"_"+p.Name+"_doTestUnimage", p.rec)
+	_, err = p.Pubcli.Unimage(p.Bucket)
+	msg = step.Done()
+	if err != nil {
+		err = errors.Info(err, p.Bucket)
 		return
 	}
 	return
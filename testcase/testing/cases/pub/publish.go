@@ -3,7 +3,6 @@ package pub
 import (
 	"io"
 	"os"
-	"time"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -19,6 +18,7 @@ import (
 	"qbox.me/api/rs"
 	"qbox.me/api/pub"
 	"qbox.me/api/util"
+	"qbox.me/httputil"
 )
 
 type Pub struct {
@@ -29,6 +29,7 @@ type Pub struct {
 	DataSha1 string `json:"data_sha1"`
 	dataType string
 	Domain string `json:"domain"`
+	pubDomain string // Domain with a random part, regenerated by each run
 	DomainIp string `json:"domain_ip"`
 	isNormalDomain bool
 	NormalDomainRegexp string `json:"normal_domain_regexp"`
@@ -36,27 +37,32 @@ type Pub struct {
 	rsCli *rs.Service
 	pubCli *pub.Service
 	Env api.Env
+	rec *httputil.Recorder
 }
 
-func (p *Pub) Init(conf, env, path string) (err error) {
+func (p *Pub) Init(conf string, env *api.Env, path string) (err error) {
 
 	if err = config.LoadEx(p, conf); err != nil {
 		return
 	}
-	if err = config.LoadEx(&p.Env, env); err != nil {
-		return
-	}
-	dt := da.NewTransport(p.Env.AccessKey, p.Env.SecretKey, nil)
-	p.rsCli, err = rs.New(p.Env.Hosts, p.Env.Ips, dt)
+	p.Env = *env
+	p.rec = httputil.NewRecorder(p.Env.Transport())
+	dt := da.NewTransport(p.Env.AccessKey, p.Env.SecretKey, p.Env.Retrying(p.rec))
+	p.rsCli, err = rs.New(p.Env.Hosts, p.Env.URLs(), dt)
 	if err != nil {
 		err = errors.Info(err, "Pub init failed")
 		return
 	}
-	p.pubCli, err = pub.New(p.Env.Hosts["pu"], p.Env.Ips["pu"], dt)
+	p.pubCli, err = pub.New(p.Env.Hosts["pu"], p.Env.URL("pu"), dt)
 	if err != nil {
 		err = errors.Info(err, "Pub init failed")
 		return
 	}
+	if p.DataSha1 == "" {
+		if p.DataSha1, err = util.DataSha1(path, p.DataFile); err != nil {
+			return
+		}
+	}
 	p.DataFile = filepath.Join(path, p.DataFile)
 	domainRegexp, err := regexp.Compile(p.NormalDomainRegexp)
 	if err != nil {
@@ -68,6 +74,10 @@ func (p *Pub) Init(conf, env, path string) (err error) {
 	return
 }
 
+func (p *Pub) Services() []string {
+	return []string{"rs", "io"}
+}
+
 func (p *Pub) doTestUpload() (msg string, err error) {
 
 	p.dataType = "application/qbox-mon"
@@ -79,13 +89,15 @@ func (p *Pub) doTestUpload() (msg string, err error) {
 	}
 	defer f.Close()
 	fi, _ := f.Stat()
-	begin := time.Now()
-	_, _, err = p.rsCli.Put(entryName, p.dataType, f, fi.Size())
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("Pb    "+p.Env.Id+"_"+p.Name+"_doTestUpload", begin, end, duration)
+	step := util.NewStep("Pb    "+p.Env.Id+"_"+p.Name+"_doTestUpload", p.rec)
+	ret, _, err := p.rsCli.Put(entryName, p.dataType, f, fi.Size())
+	msg = step.Done()
 	if err != nil {
 		err = errors.Info(err, "upload failed:", entryName)
+		return
+	}
+	if err = util.CheckEtag(p.DataFile, ret.Hash); err != nil {
+		err = errors.Info(err, entryName)
 	}
 	return
 }
@@ -93,18 +105,17 @@ func (p *Pub) doTestUpload() (msg string, err error) {
 func (p *Pub) doTestPublish() (msg string, err error) {
 
 	if p.isNormalDomain {
-		p.Domain = p.Domain + "/" + strconv.FormatInt(rand.Int63(), 10)
+		p.pubDomain = p.Domain + "/" + strconv.FormatInt(rand.Int63(), 10)
 	} else {
-		p.Domain = strconv.FormatInt(rand.Int63(), 10) + "." + p.Domain
+		p.pubDomain = strconv.FormatInt(rand.Int63(), 10) + "." + p.Domain
 	}
-	begin := time.Now()
-	if _, err = p.rsCli.Publish(p.Domain, p.Bucket); err != nil {
-		err = errors.Info(err, "Publish failed: ", p.Bucket, p.Domain)
+	step := util.NewStep("Pb    "+p.Env.Id+"_"+p.Name+"_doTestPublish", p.rec)
+	_, err = p.rsCli.Publish(p.pubDomain, p.Bucket)
+	msg = step.Done()
+	if err != nil {
+		err = errors.Info(err, "Publish failed: ", p.Bucket, p.pubDomain)
 		return
 	}
-	end := time.Now() 
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("Pb    "+p.Env.Id+"_"+p.Name+"_doTestPublish", begin, end, duration)
 	return
 }
 
@@ -114,7 +125,7 @@ func (p *Pub) doTestDownload() (msg string, err error) {
 		url string
 	)
 	if p.isNormalDomain {
-		url = "http://" + p.Domain + "/" + p.Key
+		url = "http://" + p.pubDomain + "/" + p.Key
 	} else {
 		url = "http://" + p.DomainIp + "/" + p.Key
 	}
@@ -124,18 +135,19 @@ func (p *Pub) doTestDownload() (msg string, err error) {
 		return
 	}
 	if !p.isNormalDomain {
-		req.Host = p.Domain
+		req.Host = p.pubDomain
 	}
-	begin := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("Fp    "+p.Env.Id+"_"+p.Name+"_doTestDownload", begin, end, duration)
+	step := util.NewStep("Fp    "+p.Env.Id+"_"+p.Name+"_doTestDownload", p.rec)
+	resp, err := p.rec.Client().Do(req)
 	if err != nil {
+		msg = step.Done()
 		err = errors.Info(err, "Download failed:", url)
 		return
 	}
-	defer resp.Body.Close()
+	defer func() {
+		resp.Body.Close()
+		msg = step.Done()
+	}()
 	if resp.StatusCode/100 != 2 {
 		err = errors.New("download status code is not 20x!")
 		err = errors.Info(err, url, resp.StatusCode)
@@ -162,14 +174,13 @@ func (p *Pub) doTestDownload() (msg string, err error) {
 
 
 func (p *Pub) doTestUnpublish() (msg string, err error) {
-	begin := time.Now()
-	if _, err = p.rsCli.Unpublish(p.Domain); err != nil {
-		err = errors.Info(err, "unpublish domain failed", p.Domain)
+	step := util.NewStep("Pb    "+p.Env.Id+"_"+p.Name+"_doTestUnpublish", p.rec)
+	_, err = p.rsCli.Unpublish(p.pubDomain)
+	msg = step.Done()
+	if err != nil {
+		err = errors.Info(err, "unpublish domain failed", p.pubDomain)
 		return
 	}
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("Pb    "+p.Env.Id+"_"+p.Name+"_doTestUnpublish", begin, end, duration)
 	return
 }
 
@@ -0,0 +1,224 @@
+package rs
+
+import (
+	stderrors "errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"qbox.us/cc/config"
+	"qbox.us/errors"
+	da "qbox.me/auth/digest"
+	"qbox.me/api"
+	"qbox.me/api/rs"
+	"qbox.me/api/util"
+	"qbox.me/errcode"
+	"qbox.me/httputil"
+)
+
+// RsBatch uploads Count keys, then stats, copies, moves and deletes them in
+// batches of Limit ops, checking the result of every op.
+type RsBatch struct {
+	Name        string `json:"name"`
+	Bucket      string `json:"bucket"`
+	Prefix      string `json:"prefix"`
+	Count       int    `json:"count"`
+	Limit       int    `json:"limit"`       // ops per batch request
+	Concurrency int    `json:"concurrency"` // batch requests in flight
+
+	runPrefix string
+	uploaded  int
+
+	Conn *rs.Service
+	Env  api.Env
+	rec  *httputil.Recorder
+}
+
+func (self *RsBatch) Init(conf string, env *api.Env, path string) (err error) {
+
+	if err = config.LoadEx(self, conf); err != nil {
+		return
+	}
+	self.Env = *env
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	dt := da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	self.Conn, err = rs.New(self.Env.Hosts, self.Env.URLs(), dt)
+	return
+}
+
+func (self *RsBatch) Services() []string {
+	return []string{"rs", "io"}
+}
+
+func (self *RsBatch) entry(name string, i int) string {
+	return self.Bucket + ":" + self.runPrefix + name + "_" + strconv.Itoa(i)
+}
+
+func (self *RsBatch) newBatcher() *rs.Batcher {
+	b := self.Conn.NewBatcher()
+	b.Limit, b.Concurrency = self.Limit, self.Concurrency
+	return b
+}
+
+// exec runs b and checks that every op succeeded if want is nil, or failed
+// with want.
+func exec(b *rs.Batcher, want error) (err error) {
+
+	items, err := b.Exec()
+	if err != nil {
+		return errors.Info(err, "batch failed")
+	}
+	for _, item := range items {
+		if want == nil && item.Err != nil {
+			return errors.Info(item.Err, "batch op failed:", item.Op)
+		}
+		if want != nil && !stderrors.Is(item.Err, want) {
+			return errors.Info(errors.New("unexpected batch op result"), item.Op, item.Err, want)
+		}
+	}
+	return nil
+}
+
+func (self *RsBatch) doTestUpload() (msg string, err error) {
+
+	self.runPrefix = self.Prefix + strconv.FormatInt(rand.Int63(), 36) + "/"
+	self.uploaded = 0
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTestUpload", self.rec)
+	for i := 0; i < self.Count; i++ {
+		entry := self.entry("src", i)
+		_, _, err = self.Conn.Put(entry, "", strings.NewReader(entry), int64(len(entry)))
+		if err != nil {
+			err = errors.Info(err, "upload failed:", entry)
+			break
+		}
+		self.uploaded++
+	}
+	msg = step.Done()
+	return
+}
+
+func (self *RsBatch) doTestStat() (msg string, err error) {
+
+	b := self.newBatcher()
+	for i := 0; i < self.uploaded; i++ {
+		b.Stat(self.entry("src", i))
+	}
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTestStat", self.rec)
+	items, err := b.Exec()
+	msg = step.Done()
+	if err != nil {
+		err = errors.Info(err, "batch stat failed")
+		return
+	}
+	for i, item := range items {
+		if item.Err != nil {
+			return msg, errors.Info(item.Err, "batch stat failed:", item.Op)
+		}
+		data, _ := item.Ret.Data.(map[string]interface{})
+		fsize, _ := data["fsize"].(float64)
+		if int(fsize) != len(self.entry("src", i)) {
+			return msg, errors.Info(errors.New("unexpected fsize"), item.Op, data["fsize"])
+		}
+	}
+	return
+}
+
+func (self *RsBatch) doTestCopyMove() (msg string, err error) {
+
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTestCopyMove", self.rec)
+	defer func() { msg = step.Done() }()
+
+	b := self.newBatcher()
+	for i := 0; i < self.uploaded; i++ {
+		b.Copy(self.entry("src", i), self.entry("copy", i))
+	}
+	if err = exec(b, nil); err != nil {
+		return
+	}
+	b = self.newBatcher()
+	for i := 0; i < self.uploaded; i++ {
+		b.Move(self.entry("copy", i), self.entry("moved", i))
+	}
+	if err = exec(b, nil); err != nil {
+		return
+	}
+
+	// the copies are gone, the moved ones are there
+	b = self.newBatcher()
+	for i := 0; i < self.uploaded; i++ {
+		b.Stat(self.entry("copy", i))
+	}
+	if err = exec(b, errcode.ENoSuchEntry); err != nil {
+		return
+	}
+	b = self.newBatcher()
+	for i := 0; i < self.uploaded; i++ {
+		b.Stat(self.entry("moved", i))
+	}
+	err = exec(b, nil)
+	return
+}
+
+func (self *RsBatch) doTestDelete() (msg string, err error) {
+
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTestDelete", self.rec)
+	defer func() { msg = step.Done() }()
+
+	// which of the copies exist depends on how far the case went
+	names := []string{"src", "copy", "moved"}
+	b := self.newBatcher()
+	for i := 0; i < self.uploaded; i++ {
+		for _, name := range names {
+			b.Delete(self.entry(name, i))
+		}
+	}
+	items, err := b.Exec()
+	if err != nil {
+		err = errors.Info(err, "batch delete failed")
+		return
+	}
+	for _, item := range items {
+		if item.Err != nil && !stderrors.Is(item.Err, errcode.ENoSuchEntry) {
+			err = errors.Info(item.Err, "batch delete failed:", item.Op)
+			return
+		}
+	}
+
+	b = self.newBatcher()
+	for i := 0; i < self.uploaded; i++ {
+		for _, name := range names {
+			b.Stat(self.entry(name, i))
+		}
+	}
+	err = exec(b, errcode.ENoSuchEntry)
+	return
+}
+
+func (self *RsBatch) Test() (msg string, err error) {
+
+	log1, err := self.doTestUpload()
+	if err == nil {
+		msg += fmt.Sprintln(log1, " ok")
+		log1, err = self.doTestStat()
+	}
+	if err == nil {
+		msg += fmt.Sprintln(log1, " ok")
+		log1, err = self.doTestCopyMove()
+	}
+	if err != nil {
+		msg += fmt.Sprintln(log1, err)
+	} else {
+		msg += fmt.Sprintln(log1, " ok")
+	}
+
+	log1, err1 := self.doTestDelete()
+	if err1 != nil {
+		msg += fmt.Sprintln(log1, err1)
+		if err == nil {
+			err = err1
+		}
+	} else {
+		msg += fmt.Sprintln(log1, " ok")
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package rs
+
+import (
+	"crypto/sha1"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"qbox.us/cc/config"
+	"qbox.us/errors"
+	da "qbox.me/auth/digest"
+	"qbox.me/api"
+	"qbox.me/api/rs"
+	"qbox.me/api/util"
+	"qbox.me/errcode"
+	"qbox.me/httputil"
+)
+
+// RsConsistency writes a key, then overwrites it, and after each write
+// polls Stat and a download from io concurrently, each until it returns
+// what was written. Every read which doesn't is a stale read, and fails
+// the case.
+type RsConsistency struct {
+	Name         string `json:"name"`
+	Bucket       string `json:"bucket"`
+	Prefix       string `json:"prefix"`
+	PollInterval int    `json:"poll_interval"` // ms, 100 if 0
+	MaxWait      int    `json:"max_wait"`      // s, how long to poll before giving up, 10 if 0
+
+	entry string
+
+	Conn *rs.Service
+	Env  api.Env
+	rec  *httputil.Recorder
+}
+
+func (self *RsConsistency) Init(conf string, env *api.Env, path string) (err error) {
+
+	if err = config.LoadEx(self, conf); err != nil {
+		return
+	}
+	if self.PollInterval <= 0 {
+		self.PollInterval = 100
+	}
+	if self.MaxWait <= 0 {
+		self.MaxWait = 10
+	}
+	self.Env = *env
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	dt := da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	self.Conn, err = rs.New(self.Env.Hosts, self.Env.URLs(), dt)
+	return
+}
+
+func (self *RsConsistency) Services() []string {
+	return []string{"rs", "io"}
+}
+
+// visibility is what polling one kind of read after a write observed.
+type visibility struct {
+	Kind  string
+	After time.Duration // from the end of the write to the first fresh read
+	Stale int
+	Reads int
+	Seen  bool
+}
+
+func (v visibility) String() string {
+	if !v.Seen {
+		return fmt.Sprintf("%v never visible, %v stale reads", v.Kind, v.Stale)
+	}
+	return fmt.Sprintf("%v visible after %.3fs, %v/%v stale reads", v.Kind, v.After.Seconds(), v.Stale, v.Reads)
+}
+
+// poll calls read until it returns true, or MaxWait elapsed since written.
+func (self *RsConsistency) poll(kind string, written time.Time, read func() (bool, error)) (v visibility, err error) {
+
+	v.Kind = kind
+	deadline := written.Add(time.Duration(self.MaxWait) * time.Second)
+	for {
+		var fresh bool
+		if fresh, err = read(); err != nil {
+			return
+		}
+		v.Reads++
+		if fresh {
+			v.After, v.Seen = time.Since(written), true
+			return
+		}
+		v.Stale++
+		if time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(time.Duration(self.PollInterval) * time.Millisecond)
+	}
+}
+
+func (self *RsConsistency) statFresh(hash string) func() (bool, error) {
+	return func() (bool, error) {
+		entry, _, err := self.Conn.Stat(self.entry)
+		if stderrors.Is(err, errcode.ENoSuchEntry) {
+			return false, nil
+		}
+		return err == nil && entry.Hash == hash, err
+	}
+}
+
+func (self *RsConsistency) downloadFresh(sum [sha1.Size]byte) func() (bool, error) {
+	return func() (bool, error) {
+		ret, _, err := self.Conn.Get(self.entry, "", "", 3600)
+		if stderrors.Is(err, errcode.ENoSuchEntry) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		resp, err := self.rec.Client().Get(ret.URL)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+		h := sha1.New()
+		io.Copy(h, resp.Body)
+		return resp.StatusCode == 200 && string(h.Sum(nil)) == string(sum[:]), nil
+	}
+}
+
+// doTestWrite puts content to the key, then polls until it is visible.
+func (self *RsConsistency) doTestWrite(what, content string) (msg string, err error) {
+
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTest"+what, self.rec)
+	ret, _, err := self.Conn.Put(self.entry, "text/plain", strings.NewReader(content), int64(len(content)))
+	written := time.Now()
+	if err != nil {
+		msg = step.Done()
+		err = errors.Info(err, what, "failed:", self.entry)
+		return
+	}
+
+	// io may serve stale content while stat does, so both are polled from
+	// the write on
+	reads := []struct {
+		kind string
+		read func() (bool, error)
+	}{
+		{"stat", self.statFresh(ret.Hash)},
+		{"io", self.downloadFresh(sha1.Sum([]byte(content)))},
+	}
+	vs, errs := make([]visibility, len(reads)), make([]error, len(reads))
+	var wg sync.WaitGroup
+	for i, r := range reads {
+		wg.Add(1)
+		go func(i int, kind string, read func() (bool, error)) {
+			defer wg.Done()
+			vs[i], errs[i] = self.poll(kind, written, read)
+		}(i, r.kind, r.read)
+	}
+	wg.Wait()
+	msg = step.Done()
+	for _, v := range vs {
+		msg += "  " + v.String()
+	}
+	for i, err1 := range errs {
+		if err1 != nil {
+			err = errors.Info(err1, what, reads[i].kind, "read failed:", self.entry)
+			return
+		}
+	}
+	for _, v := range vs {
+		if v.Stale > 0 {
+			err = errors.Info(errors.New("stale read"), what, self.entry, v.String())
+			return
+		}
+	}
+	return
+}
+
+func (self *RsConsistency) Test() (msg string, err error) {
+
+	run := strconv.FormatInt(rand.Int63(), 36)
+	self.entry = self.Bucket + ":" + self.Prefix + run
+
+	log1, err := self.doTestWrite("Put", "v1 "+run)
+	if err == nil {
+		msg += fmt.Sprintln(log1, " ok")
+		log1, err = self.doTestWrite("Overwrite", "v2 "+run+" overwritten")
+	}
+	if err != nil {
+		msg += fmt.Sprintln(log1, err)
+	} else {
+		msg += fmt.Sprintln(log1, " ok")
+	}
+
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTestDelete", self.rec)
+	_, err1 := self.Conn.Delete(self.entry)
+	log1 = step.Done()
+	if err1 != nil && !stderrors.Is(err1, errcode.ENoSuchEntry) {
+		msg += fmt.Sprintln(log1, err1)
+		if err == nil {
+			err = errors.Info(err1, "delete failed:", self.entry)
+		}
+	} else {
+		msg += fmt.Sprintln(log1, " ok")
+	}
+	return
+}
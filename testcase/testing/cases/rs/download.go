@@ -0,0 +1,266 @@
+package rs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"qbox.us/cc/config"
+	"qbox.us/errors"
+	da "qbox.me/auth/digest"
+	"qbox.me/api"
+	"qbox.me/api/rs"
+	"qbox.me/api/util"
+	"qbox.me/httputil"
+)
+
+// IoDownload uploads DataFile, then checks the download url given by Get
+// against the local file: headers, HEAD, Ranges random ranges, a suffix
+// range, an unsatisfiable range and the conditional GETs.
+type IoDownload struct {
+	Name     string `json:"name"`
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	DataFile string `json:"data_file"`
+	MimeType string `json:"mime_type"`
+	AttName  string `json:"att_name"`
+	Ranges   int    `json:"ranges"` // random ranges to check, 3 if 0
+
+	data []byte
+	url  string
+
+	Conn *rs.Service
+	Env  api.Env
+	rec  *httputil.Recorder
+}
+
+func (self *IoDownload) Init(conf string, env *api.Env, path string) (err error) {
+
+	if err = config.LoadEx(self, conf); err != nil {
+		return
+	}
+	if self.Ranges <= 0 {
+		self.Ranges = 3
+	}
+	if self.MimeType == "" {
+		self.MimeType = "application/octet-stream"
+	}
+	self.Env = *env
+	self.DataFile = filepath.Join(path, self.DataFile)
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	dt := da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	self.Conn, err = rs.New(self.Env.Hosts, self.Env.URLs(), dt)
+	return
+}
+
+func (self *IoDownload) Services() []string {
+	return []string{"rs", "io"}
+}
+
+func (self *IoDownload) doTestUpload() (msg string, err error) {
+
+	if self.data, err = ioutil.ReadFile(self.DataFile); err != nil {
+		return
+	}
+	entry := self.Bucket + ":" + self.Key
+	step := util.NewStep("IO    "+self.Env.Id+"_"+self.Name+"_doTestUpload", self.rec)
+	defer func() { msg = step.Done() }()
+	_, _, err = self.Conn.Put(entry, self.MimeType, bytes.NewReader(self.data), int64(len(self.data)))
+	if err != nil {
+		err = errors.Info(err, "upload failed:", entry)
+		return
+	}
+	ret, _, err := self.Conn.Get(entry, "", self.AttName, 3600)
+	if err != nil {
+		err = errors.Info(err, "get failed:", entry)
+		return
+	}
+	self.url = ret.URL
+	return
+}
+
+func (self *IoDownload) request(method string, header map[string]string) (resp *http.Response, body []byte, err error) {
+
+	req, err := http.NewRequest(method, self.url, nil)
+	if err != nil {
+		return
+	}
+	// no transparent gzip, the headers are checked as sent
+	req.Header.Set("Accept-Encoding", "identity")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if resp, err = self.rec.Client().Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+func expectStatus(resp *http.Response, code int, what string) error {
+	if resp.StatusCode != code {
+		return errors.Info(errors.New("unexpected status"), what, resp.StatusCode, "expected", code)
+	}
+	return nil
+}
+
+func expectHeader(resp *http.Response, k, want string) error {
+	if v := resp.Header.Get(k); v != want {
+		return errors.Info(errors.New("unexpected header"), k, v, "expected", want)
+	}
+	return nil
+}
+
+func (self *IoDownload) checkGet() (err error) {
+
+	resp, body, err := self.request("GET", nil)
+	if err != nil {
+		return
+	}
+	if err = expectStatus(resp, 200, "GET"); err != nil {
+		return
+	}
+	if err = expectHeader(resp, "Content-Length", strconv.Itoa(len(self.data))); err != nil {
+		return
+	}
+	if err = expectHeader(resp, "Content-Type", self.MimeType); err != nil {
+		return
+	}
+	if self.AttName != "" {
+		if cd := resp.Header.Get("Content-Disposition"); !strings.Contains(cd, self.AttName) {
+			return errors.Info(errors.New("unexpected Content-Disposition"), cd, "expected", self.AttName)
+		}
+	}
+	if !bytes.Equal(body, self.data) {
+		return errors.New("body differs from " + self.DataFile)
+	}
+	return
+}
+
+func (self *IoDownload) checkHead() (err error) {
+
+	resp, body, err := self.request("HEAD", nil)
+	if err != nil {
+		return
+	}
+	if err = expectStatus(resp, 200, "HEAD"); err != nil {
+		return
+	}
+	if len(body) != 0 {
+		return errors.Info(errors.New("HEAD returned a body"), len(body))
+	}
+	return expectHeader(resp, "Content-Length", strconv.Itoa(len(self.data)))
+}
+
+// checkRange GETs bytes=first-last (first < 0 for a suffix of -first bytes)
+// and compares the answer with the local data.
+func (self *IoDownload) checkRange(first, last int) (err error) {
+
+	size := len(self.data)
+	spec := fmt.Sprintf("bytes=%d-%d", first, last)
+	if first < 0 {
+		spec = fmt.Sprintf("bytes=%d", first)
+		first, last = size+first, size-1
+	}
+	resp, body, err := self.request("GET", map[string]string{"Range": spec})
+	if err != nil {
+		return
+	}
+	if err = expectStatus(resp, 206, spec); err != nil {
+		return
+	}
+	if err = expectHeader(resp, "Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, size)); err != nil {
+		return errors.Info(err, spec)
+	}
+	if !bytes.Equal(body, self.data[first:last+1]) {
+		return errors.Info(errors.New("range body differs"), spec, len(body))
+	}
+	return
+}
+
+func (self *IoDownload) checkConditional() (err error) {
+
+	resp, _, err := self.request("HEAD", nil)
+	if err != nil {
+		return
+	}
+	conds := map[string]string{
+		"If-None-Match":     resp.Header.Get("ETag"),
+		"If-Modified-Since": resp.Header.Get("Last-Modified"),
+	}
+	for k, v := range conds {
+		if v == "" {
+			return errors.Info(errors.New("no validator for"), k)
+		}
+		if resp, _, err = self.request("GET", map[string]string{k: v}); err != nil {
+			return
+		}
+		if err = expectStatus(resp, 304, k+": "+v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+type ioCheck struct {
+	name  string
+	check func() error
+}
+
+func (self *IoDownload) Test() (msg string, err error) {
+
+	log1, err := self.doTestUpload()
+	if err != nil {
+		msg += fmt.Sprintln(log1, err)
+		return
+	}
+	msg += fmt.Sprintln(log1, " ok")
+
+	size := len(self.data)
+	checks := []ioCheck{
+		{"Get", self.checkGet},
+		{"Head", self.checkHead},
+		{"Conditional", self.checkConditional},
+	}
+	for i := 0; i < self.Ranges && size > 0; i++ {
+		first := rand.Intn(size)
+		last := first + rand.Intn(size-first)
+		checks = append(checks, ioCheck{"Range", func() error { return self.checkRange(first, last) }})
+	}
+	if size > 0 {
+		n := 1 + rand.Intn(size)
+		checks = append(checks, ioCheck{"SuffixRange", func() error { return self.checkRange(-n, 0) }})
+	}
+	checks = append(checks, ioCheck{"UnsatisfiableRange", func() error {
+		resp, _, err := self.request("GET", map[string]string{"Range": fmt.Sprintf("bytes=%d-", size)})
+		if err != nil {
+			return err
+		}
+		return expectStatus(resp, 416, "Range past the end")
+	}})
+
+	for _, c := range checks {
+		step := util.NewStep("IO    "+self.Env.Id+"_"+self.Name+"_doTest"+c.name, self.rec)
+		err1 := c.check()
+		log1 = step.Done()
+		if err1 != nil {
+			msg += fmt.Sprintln(log1, err1)
+			if err == nil {
+				err = err1
+			}
+		} else {
+			msg += fmt.Sprintln(log1, " ok")
+		}
+	}
+
+	entry := self.Bucket + ":" + self.Key
+	if _, err1 := self.Conn.Delete(entry); err1 != nil && err == nil {
+		err = errors.Info(err1, "delete failed:", entry)
+	}
+	return
+}
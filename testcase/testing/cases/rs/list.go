@@ -0,0 +1,143 @@
+package rs
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"qbox.us/cc/config"
+	"qbox.us/errors"
+	da "qbox.me/auth/digest"
+	"qbox.me/api"
+	"qbox.me/api/rs"
+	"qbox.me/api/util"
+	"qbox.me/httputil"
+)
+
+// RsList uploads Count keys under a prefix unique to the run, then checks
+// that listing the prefix page by page returns exactly those keys, in order.
+type RsList struct {
+	Name   string `json:"name"`
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	Count  int    `json:"count"`
+	Limit  int    `json:"limit"` // items per page
+
+	runPrefix string
+	keys      []string
+
+	Conn *rs.Service
+	Env  api.Env
+	rec  *httputil.Recorder
+}
+
+func (self *RsList) Init(conf string, env *api.Env, path string) (err error) {
+
+	if err = config.LoadEx(self, conf); err != nil {
+		return
+	}
+	self.Env = *env
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	dt := da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	self.Conn, err = rs.New(self.Env.Hosts, self.Env.URLs(), dt)
+	return
+}
+
+func (self *RsList) Services() []string {
+	return []string{"rs", "rsf", "io"}
+}
+
+func (self *RsList) doTestUpload() (msg string, err error) {
+
+	self.runPrefix = self.Prefix + strconv.FormatInt(rand.Int63(), 36) + "/"
+	self.keys = nil
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTestUpload", self.rec)
+	for i := 0; i < self.Count; i++ {
+		key := fmt.Sprintf("%s%04d", self.runPrefix, i)
+		_, _, err = self.Conn.Put(self.Bucket+":"+key, "", strings.NewReader(key), int64(len(key)))
+		if err != nil {
+			err = errors.Info(err, "upload failed:", key)
+			break
+		}
+		self.keys = append(self.keys, key)
+	}
+	msg = step.Done()
+	return
+}
+
+func (self *RsList) doTestList() (msg string, err error) {
+
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTestList", self.rec)
+	l := self.Conn.NewLister(self.Bucket, self.runPrefix, self.Limit)
+	var keys []string
+	for l.Next() {
+		item := l.Item()
+		if item.Fsize != int64(len(item.Key)) {
+			err = errors.Info(errors.New("unexpected fsize"), item.Key, item.Fsize, len(item.Key))
+			break
+		}
+		keys = append(keys, item.Key)
+	}
+	msg = step.Done() + fmt.Sprintf("  pages %v", l.Pages())
+	if err != nil {
+		return
+	}
+	if err = l.Err(); err != nil {
+		err = errors.Info(err, "list failed:", self.Bucket, self.runPrefix)
+		return
+	}
+	if len(keys) != len(self.keys) {
+		err = errors.Info(errors.New("unexpected key count"), len(keys), len(self.keys))
+		return
+	}
+	for i, key := range keys {
+		if key != self.keys[i] {
+			err = errors.Info(errors.New("unexpected key"), i, key, self.keys[i])
+			return
+		}
+	}
+	return
+}
+
+func (self *RsList) doTestDelete() (msg string, err error) {
+
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTestDelete", self.rec)
+	for _, key := range self.keys {
+		if _, err1 := self.Conn.Delete(self.Bucket + ":" + key); err1 != nil && err == nil {
+			err = errors.Info(err1, "delete failed:", key)
+		}
+	}
+	msg = step.Done()
+	return
+}
+
+func (self *RsList) Test() (msg string, err error) {
+
+	if self.Env.URL("rsf") == "" {
+		err = errors.Info(util.ErrSkipped, "no rsf service in env", self.Env.Id)
+		return
+	}
+
+	log1, err := self.doTestUpload()
+	if err == nil {
+		msg += fmt.Sprintln(log1, " ok")
+		log1, err = self.doTestList()
+	}
+	if err != nil {
+		msg += fmt.Sprintln(log1, err)
+	} else {
+		msg += fmt.Sprintln(log1, " ok")
+	}
+
+	// clean up whatever was uploaded, even if the listing failed
+	log1, err1 := self.doTestDelete()
+	if err1 != nil {
+		msg += fmt.Sprintln(log1, err1)
+		if err == nil {
+			err = err1
+		}
+	} else {
+		msg += fmt.Sprintln(log1, " ok")
+	}
+	return
+}
@@ -0,0 +1,237 @@
+package rs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"qbox.us/cc/config"
+	"qbox.us/errors"
+	da "qbox.me/auth/digest"
+	"qbox.me/api"
+	"qbox.me/api/rs"
+	"qbox.me/api/util"
+	"qbox.me/httputil"
+	"qbox.me/qetag"
+)
+
+// ScenarioStep is one rs operation of a scenario. The string fields may
+// refer to variables as ${name}, see RsScenario.
+//
+// Op is one of:
+//
+//	put       Entry from DataFile (see util.DataFile) with MimeType, gives
+//	          hash, fsize, sha1 and qetag, the hash computed locally
+//	stat      Entry, gives hash, fsize and mime_type
+//	get       Entry with AttName, gives url, hash, fsize and mime_type
+//	download  URL, gives sha1 and fsize of the body
+//	copy      Entry to Dest
+//	move      Entry to Dest
+//	delete    Entry
+//
+// Every step also gives code. Expect maps these fields to their expected
+// values, which may refer to the fields too, e.g. {"hash": "${qetag}"};
+// code defaults to 200. Save maps variable names to fields.
+type ScenarioStep struct {
+	Op       string `json:"op"`
+	Entry    string `json:"entry"`
+	Dest     string `json:"dest"`
+	DataFile util.DataFile `json:"data_file"`
+	MimeType string        `json:"mime_type"`
+	AttName  string        `json:"att_name"`
+	URL      string        `json:"url"`
+
+	Expect map[string]interface{} `json:"expect"`
+	Save   map[string]string      `json:"save"`
+	Always bool                   `json:"always"` // run even if a previous step failed, e.g. a cleanup
+}
+
+// RsScenario runs Steps in order. The variables are bucket, env (the env
+// id) and run, a random string regenerated by each run, then Vars, which
+// may refer to these three, then those saved by the steps.
+type RsScenario struct {
+	Name   string            `json:"name"`
+	Bucket string            `json:"bucket"`
+	Vars   map[string]string `json:"vars"`
+	Steps  []ScenarioStep    `json:"steps"`
+
+	vars     map[string]string
+	dataPath string
+
+	Conn *rs.Service
+	Env  api.Env
+	rec  *httputil.Recorder
+}
+
+func (self *RsScenario) Init(conf string, env *api.Env, path string) (err error) {
+
+	if err = config.LoadEx(self, conf); err != nil {
+		return
+	}
+	self.Env = *env
+	self.dataPath = path
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	dt := da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	self.Conn, err = rs.New(self.Env.Hosts, self.Env.URLs(), dt)
+	if err != nil {
+		return
+	}
+	for i, step := range self.Steps {
+		switch step.Op {
+		case "put", "stat", "get", "download", "copy", "move", "delete":
+		default:
+			return errors.Info(errors.New("unknown scenario op"), conf, i, step.Op)
+		}
+	}
+	return
+}
+
+func (self *RsScenario) Services() []string {
+	return []string{"rs", "io"}
+}
+
+func (self *RsScenario) expand(s string) string {
+	return os.Expand(s, func(name string) string { return self.vars[name] })
+}
+
+func (self *RsScenario) doStep(step *ScenarioStep) (err error) {
+
+	var (
+		code  int
+		entry = self.expand(step.Entry)
+		dest  = self.expand(step.Dest)
+	)
+	fields := make(map[string]string)
+
+	switch step.Op {
+	case "put":
+		d := step.DataFile
+		if d.Gen == nil {
+			d.Path = self.expand(d.Path)
+			d.Join(self.dataPath)
+		}
+		var f util.DataReader
+		if f, err = d.Open(); err != nil {
+			return
+		}
+		defer f.Close()
+		h, etag := sha1.New(), qetag.New()
+		var ret rs.PutRet
+		body := io.TeeReader(io.NewSectionReader(f, 0, f.Size()), io.MultiWriter(h, etag))
+		ret, code, err = self.Conn.Put(entry, self.expand(step.MimeType), body, f.Size())
+		fields["hash"] = ret.Hash
+		fields["fsize"] = strconv.FormatInt(f.Size(), 10)
+		fields["sha1"] = hex.EncodeToString(h.Sum(nil))
+		fields["qetag"] = etag.Etag()
+	case "stat":
+		var ret rs.Entry
+		ret, code, err = self.Conn.Stat(entry)
+		fields["hash"], fields["mime_type"] = ret.Hash, ret.MimeType
+		fields["fsize"] = strconv.FormatInt(ret.Fsize, 10)
+	case "get":
+		var ret rs.GetRet
+		ret, code, err = self.Conn.Get(entry, "", self.expand(step.AttName), 3600)
+		fields["url"], fields["hash"], fields["mime_type"] = ret.URL, ret.Hash, ret.MimeType
+		fields["fsize"] = strconv.FormatInt(ret.Fsize, 10)
+	case "download":
+		code, err = self.download(self.expand(step.URL), fields)
+	case "copy":
+		code, err = self.Conn.Copy(entry, dest)
+	case "move":
+		code, err = self.Conn.Move(entry, dest)
+	case "delete":
+		code, err = self.Conn.Delete(entry)
+	}
+	fields["code"] = strconv.Itoa(code)
+
+	// the expected values may also refer to the fields of this step
+	expand := func(v interface{}) string {
+		return os.Expand(expectString(v), func(name string) string {
+			if v, ok := self.vars[name]; ok {
+				return v
+			}
+			return fields[name]
+		})
+	}
+	want := "200"
+	if v, ok := step.Expect["code"]; ok {
+		want = expand(v)
+	}
+	if fields["code"] != want {
+		if err == nil {
+			err = errors.New("unexpected code")
+		}
+		return errors.Info(err, step.Op, entry, "code", code, "expected", want)
+	}
+	err = nil
+	for k, v := range step.Expect {
+		if k == "code" {
+			continue
+		}
+		if want := expand(v); fields[k] != want {
+			return errors.Info(errors.New("unexpected "+k), step.Op, entry, fields[k], "expected", want)
+		}
+	}
+	for name, k := range step.Save {
+		self.vars[name] = fields[k]
+	}
+	return
+}
+
+// expectString formats an expected value of a step. The json numbers are
+// float64, which fmt prints as 5e+06 from 1e6 on.
+func expectString(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func (self *RsScenario) download(url string, fields map[string]string) (code int, err error) {
+
+	resp, err := self.rec.Client().Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	h := sha1.New()
+	n, err := io.Copy(h, resp.Body)
+	code = resp.StatusCode
+	fields["sha1"] = hex.EncodeToString(h.Sum(nil))
+	fields["fsize"] = strconv.FormatInt(n, 10)
+	return
+}
+
+func (self *RsScenario) Test() (msg string, err error) {
+
+	self.vars = map[string]string{
+		"bucket": self.Bucket,
+		"env":    self.Env.Id,
+		"run":    strconv.FormatInt(rand.Int63(), 36),
+	}
+	for k, v := range self.Vars {
+		self.vars[k] = self.expand(v)
+	}
+
+	for i := range self.Steps {
+		step := &self.Steps[i]
+		if err != nil && !step.Always {
+			continue
+		}
+		s := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_"+strconv.Itoa(i)+"_"+step.Op, self.rec)
+		err1 := self.doStep(step)
+		log1 := s.Done()
+		if err1 != nil {
+			msg += fmt.Sprintln(log1, err1)
+			if err == nil {
+				err = err1
+			}
+		} else {
+			msg += fmt.Sprintln(log1, " ok")
+		}
+	}
+	return
+}
@@ -0,0 +1,229 @@
+package up
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"qbox.us/cc/config"
+	"qbox.us/errors"
+	"qbox.me/auth/digest"
+	"qbox.me/auth/uptoken"
+	"qbox.me/api"
+	"qbox.me/api/rs"
+	"qbox.me/api/util"
+	"qbox.me/errcode"
+	"qbox.me/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	callbackOK      = "ok"      // the callback answers a json, relayed by up
+	callbackError   = "error"   // the callback answers 500
+	callbackTimeout = "timeout" // the callback answers after callback_delay
+)
+
+// UpFormCallback uploads DataFile by a form with CallbackParam, its upToken
+// having the callbackUrl of a receiver started by the case. The callback
+// must arrive, signed with the keys of the env, with CallbackParam as its
+// body. In the callbackOK mode, the upload answers what the callback did;
+// in the others, the upload fails with ExpectedCode.
+type UpFormCallback struct {
+	Name     string `json:"name"`
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	DataFile string `json:"data_file"`
+
+	CallbackParam  string `json:"callback_param"`  // e.g. "a=1&b=2"
+	CallbackListen string `json:"callback_listen"` // the address the receiver listens on, e.g. ":19080"
+	CallbackURL    string `json:"callback_url"`    // the receiver as the up service reaches it, e.g. "http://10.0.0.5:19080"
+	CallbackMode   string `json:"callback_mode"`   // callbackOK if empty
+	CallbackDelay  int    `json:"callback_delay"`  // ms the receiver waits in the callbackTimeout mode, 30000 if 0
+	ExpectedCode   int    `json:"expected_code"`   // of the upload if the callback fails, errcode.CallbackFailed if 0
+
+	Rscli *rs.Service
+	Env   api.Env
+	rec   *httputil.Recorder
+}
+
+func (self *UpFormCallback) Init(conf string, env *api.Env, path string) (err error) {
+
+	if err = config.LoadEx(self, conf); err != nil {
+		return
+	}
+	switch self.CallbackMode {
+	case "":
+		self.CallbackMode = callbackOK
+	case callbackOK, callbackError, callbackTimeout:
+	default:
+		return errors.New(self.Name + ": unknown callback_mode " + self.CallbackMode)
+	}
+	if self.CallbackListen == "" || self.CallbackURL == "" {
+		return errors.New(self.Name + ": needs callback_listen and callback_url")
+	}
+	if self.CallbackDelay <= 0 {
+		self.CallbackDelay = 30000
+	}
+	if self.ExpectedCode == 0 {
+		self.ExpectedCode = errcode.CallbackFailed
+	}
+	self.Env = *env
+	self.DataFile = filepath.Join(path, self.DataFile)
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	self.Rscli, err = rs.New(self.Env.Hosts, self.Env.URLs(), dt)
+	return
+}
+
+func (self *UpFormCallback) Services() []string {
+	return []string{"up", "rs"}
+}
+
+// callback is a request the receiver got.
+type callback struct {
+	Path string
+	Body url.Values
+	Err  error // of the signature
+}
+
+// callbackReceiver answers the callbacks sent to /callback/<nonce> as mode
+// says, and passes them on to got.
+type callbackReceiver struct {
+	mode  string
+	delay time.Duration
+	ak    string
+	sk    string
+
+	srv  *http.Server
+	got  chan callback
+	done chan struct{}
+}
+
+func (self *UpFormCallback) startReceiver() (r *callbackReceiver, err error) {
+
+	r = &callbackReceiver{
+		mode: self.CallbackMode, delay: time.Duration(self.CallbackDelay) * time.Millisecond,
+		ak: self.Env.AccessKey, sk: self.Env.SecretKey,
+		got: make(chan callback, 1), done: make(chan struct{}),
+	}
+	ln, err := net.Listen("tcp", self.CallbackListen)
+	if err != nil {
+		return nil, errors.Info(err, "callback receiver failed to listen on", self.CallbackListen)
+	}
+	r.srv = &http.Server{Handler: r}
+	go r.srv.Serve(ln)
+	return
+}
+
+// Close stops the receiver and closes its connections, so none is kept
+// alive by the up service for the next attempt.
+func (r *callbackReceiver) Close() {
+	close(r.done)
+	r.srv.Close()
+}
+
+func (r *callbackReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	cb := callback{Path: req.URL.Path}
+	cb.Err = digest.Verify(req, r.ak, r.sk)
+	b, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		cb.Body, err = url.ParseQuery(string(b))
+	}
+	if err != nil && cb.Err == nil {
+		cb.Err = errors.Info(err, "bad callback body", string(b))
+	}
+	select {
+	case r.got <- cb:
+	default:
+	}
+
+	switch r.mode {
+	case callbackError:
+		w.WriteHeader(500)
+		return
+	case callbackTimeout:
+		select {
+		case <-time.After(r.delay):
+		case <-r.done:
+			return
+		}
+	}
+	nonce := strings.TrimPrefix(req.URL.Path, "/callback/")
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"nonce": %q}`, nonce)
+}
+
+func (self *UpFormCallback) doTestCallback() (msg string, err error) {
+
+	r, err := self.startReceiver()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	entryURI := self.Bucket + ":" + self.Key
+	nonce := strconv.FormatInt(rand.Int63(), 36)
+	authPolicy := &uptoken.AuthPolicy{
+		Scope:       entryURI,
+		CallbackUrl: self.CallbackURL + "/callback/" + nonce,
+		Deadline:    uint32(time.Now().Unix()) + 3600,
+	}
+	token := uptoken.MakeAuthTokenString(self.Env.AccessKey, self.Env.SecretKey, authPolicy)
+
+	var ret map[string]interface{}
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestCallback", self.rec)
+	code, err := self.Rscli.UploadRet(&ret, token, self.DataFile, entryURI, "", "", self.CallbackParam, -1, -1)
+	msg = step.Done()
+	msg += fmt.Sprintf("  callback %v, upload %v", self.CallbackMode, code)
+
+	// the up service answers once the callback is done or failed
+	var cb callback
+	select {
+	case cb = <-r.got:
+	case <-time.After(5 * time.Second):
+		return msg, errors.Info(errors.New("no callback arrived"), entryURI, code, err)
+	}
+	if cb.Path != "/callback/"+nonce {
+		return msg, errors.Info(errors.New("callback of another upload"), cb.Path, nonce)
+	}
+	if cb.Err != nil {
+		return msg, errors.Info(cb.Err, "callback signature")
+	}
+	want, _ := url.ParseQuery(self.CallbackParam)
+	for k := range want {
+		if cb.Body.Get(k) != want.Get(k) {
+			return msg, errors.Info(errors.New("callback body differs"), k, cb.Body.Get(k), want.Get(k))
+		}
+	}
+
+	if self.CallbackMode != callbackOK {
+		if err == nil || code != self.ExpectedCode {
+			return msg, errors.Info(errors.New("upload should fail"), self.CallbackMode, code, self.ExpectedCode, err)
+		}
+		return msg, nil
+	}
+	if err != nil {
+		return msg, errors.Info(err, "upload failed", entryURI, code)
+	}
+	if ret["nonce"] != nonce {
+		return msg, errors.Info(errors.New("the callback answer was not relayed"), ret, nonce)
+	}
+	return
+}
+
+func (self *UpFormCallback) Test() (msg string, err error) {
+
+	log1, err := self.doTestCallback()
+	if err != nil {
+		msg += fmt.Sprintln(log1, err)
+		return
+	}
+	msg += fmt.Sprintln(log1, " ok")
+	return
+}
@@ -13,6 +13,7 @@ import (
 	"qbox.me/api"
 	"qbox.me/api/rs"
 	"qbox.me/api/util"
+	"qbox.me/httputil"
 	"time"
 )
 
@@ -25,22 +26,31 @@ type PutFile struct {
 
 	Conn *rs.Service
 	Env  api.Env
+	rec  *httputil.Recorder
 }
 
-func (self *PutFile) Init(conf, env, path string) (err error) {
+func (self *PutFile) Init(conf string, env *api.Env, path string) (err error) {
 
 	if err = config.LoadEx(self, conf); err != nil {
 		return err
 	}
-	if err = config.LoadEx(&self.Env, env); err != nil {
-		return err
+	self.Env = *env
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	dt := da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	self.Conn, err = rs.New(self.Env.Hosts, self.Env.URLs(), dt)
+	if self.Sha1 == "" {
+		if self.Sha1, err = util.DataSha1(path, self.DataFile); err != nil {
+			return
+		}
 	}
-	dt := da.NewTransport(self.Env.AccessKey, self.Env.SecretKey, nil)
-	self.Conn, err = rs.New(self.Env.Hosts, self.Env.Ips, dt)
 	self.DataFile = filepath.Join(path, self.DataFile)
 	return
 }
 
+func (self *PutFile) Services() []string {
+	return []string{"up", "rs", "io"}
+}
+
 // upload the file and get the download url 
 func (self *PutFile) doTestPutFile() (url, msg string, err error) {
 	entry := self.BucketName + ":" + self.Key
@@ -52,17 +62,18 @@ func (self *PutFile) doTestPutFile() (url, msg string, err error) {
 	token := uptoken.MakeAuthTokenString(self.Env.AccessKey, self.Env.SecretKey, authPolicy)
 
 	// in fact, upload should be a part of Up not Rs
-	begin := time.Now()
-	_, code, err := self.Conn.Upload(entry, self.DataFile, "", "", "", token)
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("UP    "+self.Env.Id+"_"+self.Name+"_doTestPutFile", begin, end, duration)
-	if err != nil || code != 200 {
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestPutFile", self.rec)
+	ret, _, err := self.Conn.Upload(entry, self.DataFile, "", "", "", token)
+	msg = step.Done()
+	if err != nil {
+		return
+	}
+	if err = util.CheckEtag(self.DataFile, ret.Hash); err != nil {
 		return
 	}
 
-	getRet, code, err := self.Conn.Get(entry, "", "", 3600)
-	if err != nil || code != 200 {
+	getRet, _, err := self.Conn.Get(entry, "", "", 3600)
+	if err != nil {
 		return
 	}
 	url = getRet.URL
@@ -71,11 +82,9 @@ func (self *PutFile) doTestPutFile() (url, msg string, err error) {
 }
 
 func (self *PutFile) doTestCheckSha1(url string) (msg string, err error) {
-	begin := time.Now()
-	netBuf, err := util.DoHttpGet(url)
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("RS    "+self.Env.Id+"_"+self.Name+"_doTestIoDownload", begin, end, duration)
+	step := util.NewStep("RS    "+self.Env.Id+"_"+self.Name+"_doTestIoDownload", self.rec)
+	netBuf, err := util.HttpGet(self.rec.Client(), url)
+	msg = step.Done()
 	if err != nil {
 		return
 	}
@@ -3,20 +3,19 @@ package up
 import (
 	"crypto/sha1"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"qbox.us/cc/config"
 	"qbox.us/log"
+	"qbox.us/errors"
 	"qbox.me/auth/digest"
 	"qbox.me/api"
+	"qbox.me/api/resume"
 	"qbox.me/api/rs"
 	"qbox.me/api/up"
 	"qbox.me/api/util"
-	"time"
+	"qbox.me/httputil"
 )
 
 type UpResuPut struct {
@@ -24,93 +23,152 @@ type UpResuPut struct {
 	Bucket string `json:"bucket"`
 
 	Key           string `json:"key"`
-	DataFile      string `json:"data_file"`
-	DataSha1      string `json:"data_sha1"`
+	DataFile      util.DataFile `json:"data_file"`
+	DataSha1      string        `json:"data_sha1"`
 	PutRetryTimes int    `json:"put_retry_times"`
 	ExpiresTime   int    `json:"expires_time"`
 
 	ChunkSize int  `json:"chunk_size"`
 	BlockBits uint `json:"block_bits"`
 
+	ProgressFile string `json:"progress_file"` // to resume the upload in a later run if set
+
 	Url      string
 	EntryURI string
 
 	Env      api.Env
+	rec      *httputil.Recorder
 }
 
-func (self *UpResuPut) Init(conf, env, path string) (err error) {
+func (self *UpResuPut) Init(conf string, env *api.Env, path string) (err error) {
 
 	if err = config.LoadEx(self, conf); err != nil {
 		return err
 	}
-	if err = config.LoadEx(&self.Env, env); err != nil {
-		return err
+	self.Env = *env
+	if self.DataSha1 == "" && self.DataFile.Gen == nil {
+		if self.DataSha1, err = util.DataSha1(path, self.DataFile.Path); err != nil {
+			return
+		}
 	}
-	self.DataFile = filepath.Join(path, self.DataFile)
+	self.DataFile.Join(path)
+	self.rec = httputil.NewRecorder(self.Env.Transport())
 	return
 }
 
+func (self *UpResuPut) Services() []string {
+	return []string{"up", "rs", "io"}
+}
+
 func (self *UpResuPut) NewRS() (*rs.Service, error) {
-	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, nil)
-	return rs.New(self.Env.Hosts, self.Env.Ips, dt)
+	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	return rs.New(self.Env.Hosts, self.Env.URLs(), dt)
 }
 
 func (self *UpResuPut) doTestPut() (msg string, err error) {
 
-	DataFile := self.DataFile
 	entry := self.Bucket + ":" + self.Key
 	self.EntryURI = entry
-	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, nil)
+	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
 	host := self.Env.Hosts["up"]
-	ip := self.Env.Ips["up"]
+	ip := self.Env.URL("up")
 	upservice, _ := up.NewService(host, ip, self.BlockBits, self.ChunkSize, self.PutRetryTimes, dt, 1, 1)
+	upservice.Backoff = self.Env.Retry
 	log.Info(upservice)
 	
-	f, err := os.Open(DataFile)
+	f, err := self.DataFile.Open()
 	if err != nil {
 		return
 	}
 	defer f.Close()
-	fi, err := f.Stat()
-	blockCnt := upservice.BlockCount(fi.Size())
+	blockCnt := upservice.BlockCount(f.Size())
 
 	var (
 		checksums []string           = make([]string, blockCnt)
 		progs     []up.BlockProgress = make([]up.BlockProgress, blockCnt)
 		ret       up.PutRet
-		code      int
+		saver     *up.Saver
+		tr        = self.Env.Progress.Start(self.Name+" "+entry, f.Size())
+		blockSize = int64(1) << upservice.BlockBits
 	)
-	begin := time.Now()
-	code, err = upservice.Put(f, fi.Size(), checksums, progs, func(int, string) {}, func(int, *up.BlockProgress) {})
+	defer tr.Done()
+	blockNotify := func(idx int, checksum string) {
+		if n := f.Size() - int64(idx)*blockSize; n < blockSize {
+			tr.SetBlock(idx, n)
+		} else {
+			tr.SetBlock(idx, blockSize)
+		}
+	}
+	chunkNotify := func(idx int, p *up.BlockProgress) {
+		tr.SetBlock(idx, int64(p.Offset))
+	}
+	if self.ProgressFile != "" {
+		store, err1 := resume.Open(self.ProgressFile)
+		if err1 != nil {
+			err = errors.Info(err1, "open progress file failed:", self.ProgressFile)
+			return
+		}
+		var resumed bool
+		if saver, resumed, err = upservice.Resume(store, entry, f, f.Size(), checksums, progs); err != nil {
+			return
+		}
+		if resumed {
+			log.Info("resuming the upload of", entry, "from", self.ProgressFile)
+			for i, checksum := range checksums {
+				if checksum != "" {
+					blockNotify(i, checksum)
+				} else if progs[i].Ctx != "" {
+					chunkNotify(i, &progs[i])
+				}
+			}
+		}
+		blockNotify, chunkNotify = saver.BlockNotify(blockNotify), saver.ChunkNotify(chunkNotify)
+	}
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestPut", self.rec)
+	_, err = upservice.Put(f, f.Size(), checksums, progs, blockNotify, chunkNotify)
 
-	if err != nil || code != 200 {
+	if err != nil {
 		return
 	}
-	code, err = upservice.Mkfile(&ret, "/rs-mkfile/", entry, fi.Size(), "", "", checksums)
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("UP    "+self.Env.Id+"_"+self.Name+"_doTestPut", begin, end, duration)
-	if err != nil || code != 200 {
+	_, err = upservice.Mkfile(&ret, "/rs-mkfile/", entry, f.Size(), "", "", checksums)
+	msg = step.Done()
+	if err != nil {
 		return
 	}
+	if saver != nil {
+		if err1 := saver.Done(); err1 != nil {
+			log.Warn("delete progress failed:", self.ProgressFile, err1)
+		}
+	}
+	err = self.checkHash()
 	return
 }
 
+// checkHash compares the hash of the uploaded entry with the local one.
+func (self *UpResuPut) checkHash() (err error) {
+	rsservice, err := self.NewRS()
+	if err != nil {
+		return
+	}
+	entry, _, err := rsservice.Stat(self.EntryURI)
+	if err != nil {
+		return
+	}
+	return self.DataFile.CheckEtag(entry.Hash)
+}
+
 func (self *UpResuPut) doTestRSGet() (msg string, err error) {
 	var ret rs.GetRet
 
-	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, nil)
-	rsservice, err := rs.New(self.Env.Hosts, self.Env.Ips, dt)
+	rsservice, err := self.NewRS()
 	if err != nil {
 		return
 	}
-	begin := time.Now()
-	ret, code, err := rsservice.Get(self.EntryURI, "", "", 3600)
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("UP    "+self.Env.Id+"_"+self.Name+"_doTestRsGet", begin, end, duration)
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestRsGet", self.rec)
+	ret, _, err = rsservice.Get(self.EntryURI, "", "", 3600)
+	msg = step.Done()
 
-	if err != nil || code != 200 {
+	if err != nil {
 		return
 	}
 	self.Url = ret.URL
@@ -119,23 +177,26 @@ func (self *UpResuPut) doTestRSGet() (msg string, err error) {
 
 func (self *UpResuPut) doTestDownload() (msg string, err error) {
 	h := sha1.New()
-	begin := time.Now()
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestDownload", self.rec)
 	var req *http.Request
 	if req, err = http.NewRequest("GET", self.Url, nil); err != nil {
 		return
 	}
 	var resp *http.Response
-	if resp, err = http.DefaultClient.Do(req); err != nil {
+	if resp, err = self.rec.Client().Do(req); err != nil {
 		return
 	}
 	defer resp.Body.Close()
 	if _, err = io.Copy(h, resp.Body); err != nil {
 		return
 	}
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLogEx("UP    "+self.Env.Id+"_"+self.Name+"_doTestDownload", begin, end, duration)
+	msg = step.Done()
 
+	if self.DataSha1 == "" {
+		if self.DataSha1, _, err = self.DataFile.Digest(); err != nil {
+			return
+		}
+	}
 	hash := hex.EncodeToString(h.Sum(nil))
 	if hash != self.DataSha1 {
 		err = errors.New("check shal failed!")
@@ -5,17 +5,16 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"os"
-	"time"
-	"net/http"
 	"math/rand"
-	"path/filepath"
 	"qbox.us/cc/config"
+	"qbox.us/log"
 	"qbox.me/auth/digest"
 	"qbox.me/api"
+	"qbox.me/api/resume"
 	"qbox.me/api/rs"
 	"qbox.me/api/up2"
 	"qbox.me/api/util"
+	"qbox.me/httputil"
 	"qbox.us/errors"
 )
 
@@ -24,13 +23,18 @@ type UpRPut struct {
 	Bucket string `json:"bucket"`
 
 	Key           string `json:"key"`
-	DataFile      string `json:"data_file"`
-	DataSha1      string `json:"data_sha1"`
+	DataFile      util.DataFile `json:"data_file"`
+	DataSha1      string        `json:"data_sha1"`
 	PutRetryTimes int    `json:"put_retry_times"`
 	ExpiresTime   int    `json:"expires_time"`
 
 	ChunkSize int  `json:"chunk_size"`
 	BlockBits uint `json:"block_bits"`
+	SendCrc32 bool `json:"send_crc32"` // for the server to check each chunk
+
+	AdaptiveChunk *up2.ChunkPolicy `json:"adaptive_chunk"` // chunk_size is then the base size
+
+	ProgressFile string `json:"progress_file"` // to resume the upload in a later run if set
 
 	Url      string
 	EntryURI string
@@ -39,24 +43,28 @@ type UpRPut struct {
 	Up2cli *up2.Service
 
 	Env      api.Env
+	rec      *httputil.Recorder
 }
 
-func (self *UpRPut) Init(conf, env, path string) (err error) {
+func (self *UpRPut) Init(conf string, env *api.Env, path string) (err error) {
 
 	if err = config.LoadEx(self, conf); err != nil {
 		err = errors.Info(err, "UpResuPut init failed")
 		return
 	}
-	if err = config.LoadEx(&self.Env, env); err != nil {
-		err = errors.Info(err, "UpEnv init failed")
-		return
+	self.Env = *env
+	if self.DataSha1 == "" && self.DataFile.Gen == nil {
+		if self.DataSha1, err = util.DataSha1(path, self.DataFile.Path); err != nil {
+			return
+		}
 	}
-	self.DataFile = filepath.Join(path, self.DataFile)
-	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, nil)
+	self.DataFile.Join(path)
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
 	host := self.Env.Hosts["up"]
-	ip := self.Env.Ips["up"]
+	ip := self.Env.URL("up")
 
-	self.Rscli, err = rs.New(self.Env.Hosts, self.Env.Ips, dt)
+	self.Rscli, err = rs.New(self.Env.Hosts, self.Env.URLs(), dt)
 	if err != nil {
 		err = errors.Info(err, "Rscli init failed")
 		return
@@ -66,23 +74,35 @@ func (self *UpRPut) Init(conf, env, path string) (err error) {
 		err = errors.Info(err, "Up2cli init failed")
 		return
 	}
+	self.Up2cli.Backoff = self.Env.Retry
+	self.Up2cli.SendCrc32 = self.SendCrc32
+	self.Up2cli.Adaptive = self.AdaptiveChunk
 	return
 }
 
+func (self *UpRPut) Services() []string {
+	return []string{"up", "rs", "io"}
+}
+
 func (self *UpRPut) doTestRPut() (msg string, err error) {
 
-	f, err := os.Open(self.DataFile)
+	f, err := self.DataFile.Open()
 	if err != nil {
 		err = errors.Info(err, "Resumable put failed")
 		return
 	}
 	defer f.Close()
-	fi, _ := f.Stat()
 	entryURI := self.Bucket + ":" + self.Key
-	blockcnt := self.Up2cli.BlockCount(fi.Size())
+	blockcnt := self.Up2cli.BlockCount(f.Size())
 	progs := make([]up2.BlockputProgress, blockcnt)
+	tr := self.Env.Progress.Start(self.Name+" "+entryURI, f.Size())
+	defer tr.Done()
+	progressNotify := func(idx int, p *up2.BlockputProgress) {
+		tr.SetBlock(idx, p.Offset)
+	}
 	
 	chunkNotify := func(idx int, p *up2.BlockputProgress) {
+		progressNotify(idx, p)
 		if rand.Intn(blockcnt)/3 == 0 {
 			p1 := *p
 			progs[idx] = p1
@@ -90,43 +110,64 @@ func (self *UpRPut) doTestRPut() (msg string, err error) {
 	}
 	blockNotify := func(idx int, p *up2.BlockputProgress) {
 	}
-	t1 := self.Up2cli.NewRPtask(entryURI, "", "", "", "", f, fi.Size(), nil)
+	t1 := self.Up2cli.NewRPtask(entryURI, "", "", "", "", f, f.Size(), nil)
 	t1.ChunkNotify = chunkNotify
 	t1.BlockNotify = blockNotify
+	if self.ProgressFile != "" {
+		store, err1 := resume.Open(self.ProgressFile)
+		if err1 != nil {
+			err = errors.Info(err1, "open progress file failed:", self.ProgressFile)
+			return
+		}
+		resumed, err1 := t1.Resume(store)
+		if err1 != nil {
+			err = errors.Info(err1, "Resumable put failed")
+			return
+		}
+		if resumed {
+			copy(progs, t1.Progress)
+			log.Info("resuming the upload of", entryURI, "from", self.ProgressFile)
+		}
+	}
 
-	begin := time.Now()
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestRPut", self.rec)
 	for i := 0; i < blockcnt; i++ {
 		t1.PutBlock(i)
 	}
 	t1.Progress = progs
-	code, err := t1.Run(10, 10, nil, nil)
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLog("UP    "+self.Env.Id+"_"+self.Name+"_doTestRPut", begin, end, duration)
-	if err != nil || code/100 != 2 {
+	code, err := t1.Run(10, 10, progressNotify, nil)
+	msg = step.Done()
+	msg += "  " + t1.ChunkStats().String()
+	if n := t1.Crc32Mismatches(); n > 0 {
+		msg += fmt.Sprintf(", %v crc32 mismatches", n)
+	}
+	if err != nil {
 		err = errors.Info(errors.New("Resumable put failed"), entryURI, err, code)
 		return
 	}
+	entry, _, err := self.Rscli.Stat(entryURI)
+	if err != nil {
+		err = errors.Info(err, "stat failed", entryURI)
+		return
+	}
+	if err = self.DataFile.CheckEtag(entry.Hash); err != nil {
+		err = errors.Info(err, entryURI)
+	}
 	return
 }
 
 
 func (self *UpRPut) doTestGet() (msg string, err error) {
 
-	begin := time.Now()
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestGet", self.rec)
 	entryURI := self.Bucket + ":" + self.Key
-	ret, code, err := self.Rscli.Get(entryURI, "", "", 3600)
-	end := time.Now()
-	duration := end.Sub(begin)
-	msg = util.GenLog("UP    " + self.Env.Id + "_" + self.Name + "_doTestGet", begin, end, duration)
-	if err != nil || code/100 != 2 {
-		if err == nil {
-			err = errors.New("Invalid response code")
-		}
+	ret, _, err := self.Rscli.Get(entryURI, "", "", 3600)
+	msg = step.Done()
+	if err != nil {
 		err = errors.Info(err, "download failed", entryURI)
 		return
 	}
-	resp, err := http.Get(ret.URL)
+	resp, err := self.rec.Client().Get(ret.URL)
 	if err != nil {
 		err = errors.Info(err, "download failed", entryURI, ret.URL)
 		return
@@ -134,6 +175,11 @@ func (self *UpRPut) doTestGet() (msg string, err error) {
 	defer resp.Body.Close()
 	h := sha1.New()
 	io.Copy(h, resp.Body)
+	if self.DataSha1 == "" {
+		if self.DataSha1, _, err = self.DataFile.Digest(); err != nil {
+			return
+		}
+	}
 	hash := hex.EncodeToString(h.Sum(nil))
 	if hash != self.DataSha1 {
 		err = errors.Info(errors.New("Invalid data sha1"), self.DataSha1, hash)
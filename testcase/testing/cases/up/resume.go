@@ -0,0 +1,240 @@
+package up
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"qbox.us/cc/config"
+	"qbox.us/errors"
+	"qbox.me/auth/digest"
+	"qbox.me/api"
+	"qbox.me/api/rs"
+	"qbox.me/api/upload"
+	"qbox.me/api/util"
+	"qbox.me/httputil"
+)
+
+// chunkCounter counts the bytes of the mkblk and bput requests the server
+// took.
+type chunkCounter struct {
+	http.RoundTripper
+	sent int64
+}
+
+func isChunk(req *http.Request) bool {
+	return strings.Contains(req.URL.Path, "/mkblk/") || strings.Contains(req.URL.Path, "/bput/")
+}
+
+func (c *chunkCounter) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+
+	resp, err = c.RoundTripper.RoundTrip(req)
+	if isChunk(req) && err == nil && resp.StatusCode/100 == 2 {
+		atomic.AddInt64(&c.sent, req.ContentLength)
+	}
+	return
+}
+
+// UpResume cancels a resumable upload of DataFile after AbortChunks
+// chunks or AbortBlocks blocks are put, then resumes it with a fresh task
+// from the progress kept, with chunks of ResumeChunkSize. Only the missing
+// part must be sent again, and the file made must be DataFile.
+type UpResume struct {
+	Name   string `json:"name"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+
+	DataFile      util.DataFile `json:"data_file"`
+	DataSha1      string        `json:"data_sha1"`
+	PutRetryTimes int           `json:"put_retry_times"`
+	SendCrc32     bool          `json:"send_crc32"` // for the server to check each chunk
+
+	ChunkSize       int  `json:"chunk_size"`
+	ResumeChunkSize int  `json:"resume_chunk_size"` // chunk_size if 0
+	BlockBits       uint `json:"block_bits"`
+	Threads         int  `json:"threads"` // blocks put at once, 1 if 0
+
+	AbortChunks int `json:"abort_after_chunks"`
+	AbortBlocks int `json:"abort_after_blocks"`
+
+	progs   []upload.BlockProgress // kept from the interrupted task
+	missing int64
+
+	Rscli *rs.Service
+	Env   api.Env
+	sent  *chunkCounter
+	dt    http.RoundTripper
+	rec   *httputil.Recorder
+}
+
+func (self *UpResume) Init(conf string, env *api.Env, path string) (err error) {
+
+	if err = config.LoadEx(self, conf); err != nil {
+		return
+	}
+	if self.AbortChunks <= 0 && self.AbortBlocks <= 0 {
+		return errors.New(self.Name + ": neither abort_after_chunks nor abort_after_blocks")
+	}
+	if self.ResumeChunkSize == 0 {
+		self.ResumeChunkSize = self.ChunkSize
+	}
+	if self.Threads <= 0 {
+		self.Threads = 1
+	}
+	self.Env = *env
+	if self.DataSha1 == "" && self.DataFile.Gen == nil {
+		if self.DataSha1, err = util.DataSha1(path, self.DataFile.Path); err != nil {
+			return
+		}
+	}
+	self.DataFile.Join(path)
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	self.sent = &chunkCounter{RoundTripper: self.Env.Retrying(self.rec)}
+	self.dt = digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.sent)
+	self.Rscli, err = rs.New(self.Env.Hosts, self.Env.URLs(), self.dt)
+	return
+}
+
+func (self *UpResume) Services() []string {
+	return []string{"up", "rs", "io"}
+}
+
+func (self *UpResume) newService(chunkSize int) *upload.Service {
+	s := upload.New(self.Env.Hosts["up"], self.Env.URL("up"), self.BlockBits, chunkSize, self.PutRetryTimes, self.dt)
+	s.Backoff = self.Env.Retry
+	s.SendCrc32 = self.SendCrc32
+	return s
+}
+
+func (self *UpResume) doTestInterrupt(f util.DataReader) (msg string, err error) {
+
+	entryURI := self.Bucket + ":" + self.Key
+	t := self.newService(self.ChunkSize).NewTask(entryURI, f, f.Size(), nil)
+	blockSize := int64(1) << t.BlockBits // block_bits may be 0 for the default
+	var chunks, blocks int32
+	chunkNotify := func(idx int, p *upload.BlockProgress) {
+		n := atomic.AddInt32(&chunks, 1)
+		if p.Offset == blockSize || int64(idx)*blockSize+p.Offset == f.Size() {
+			if m := atomic.AddInt32(&blocks, 1); self.AbortBlocks > 0 && int(m) >= self.AbortBlocks {
+				t.Cancel()
+			}
+		}
+		if self.AbortChunks > 0 && int(n) >= self.AbortChunks {
+			t.Cancel()
+		}
+	}
+
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestInterrupt", self.rec)
+	t.Notify = []upload.Notifier{upload.NotifyFuncs{OnChunk: chunkNotify}}
+	_, err = t.Run(self.Threads, nil)
+	msg = step.Done()
+	msg += fmt.Sprintf("  %v chunks %v blocks put before the interruption", chunks, blocks)
+	if err == nil {
+		return msg, errors.New("the upload was not interrupted, lower abort_after_chunks or abort_after_blocks")
+	}
+	if err != upload.ErrCanceled {
+		return msg, errors.Info(err, "interrupted upload failed:", entryURI)
+	}
+
+	self.progs = append([]upload.BlockProgress(nil), t.Progress...)
+	self.missing = f.Size()
+	for _, p := range self.progs {
+		if p.Ctx != "" {
+			self.missing -= p.Offset
+		}
+	}
+	return msg, nil
+}
+
+func (self *UpResume) doTestResume(f util.DataReader) (msg string, err error) {
+
+	entryURI := self.Bucket + ":" + self.Key
+	t := self.newService(self.ResumeChunkSize).NewTask(entryURI, f, f.Size(), self.progs)
+
+	atomic.StoreInt64(&self.sent.sent, 0)
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestResume", self.rec)
+	code, err := t.Run(self.Threads, nil)
+	msg = step.Done()
+	sent := atomic.LoadInt64(&self.sent.sent)
+	msg += fmt.Sprintf("  resent %v of %v bytes", sent, f.Size())
+	if err != nil {
+		err = errors.Info(err, "resume failed:", entryURI, code)
+		return
+	}
+	if sent != self.missing {
+		err = errors.Info(errors.New("resent what was already put"), sent, "bytes sent, missing", self.missing)
+		return
+	}
+
+	entry, _, err := self.Rscli.Stat(entryURI)
+	if err != nil {
+		err = errors.Info(err, "stat failed", entryURI)
+		return
+	}
+	if err = self.DataFile.CheckEtag(entry.Hash); err != nil {
+		err = errors.Info(err, entryURI)
+	}
+	return
+}
+
+func (self *UpResume) doTestGet() (msg string, err error) {
+
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestGet", self.rec)
+	entryURI := self.Bucket + ":" + self.Key
+	ret, _, err := self.Rscli.Get(entryURI, "", "", 3600)
+	if err != nil {
+		msg = step.Done()
+		err = errors.Info(err, "get failed", entryURI)
+		return
+	}
+	resp, err := self.rec.Client().Get(ret.URL)
+	if err != nil {
+		msg = step.Done()
+		err = errors.Info(err, "download failed", entryURI, ret.URL)
+		return
+	}
+	defer resp.Body.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, resp.Body)
+	msg = step.Done()
+	if err != nil {
+		return
+	}
+	if self.DataSha1 == "" {
+		if self.DataSha1, _, err = self.DataFile.Digest(); err != nil {
+			return
+		}
+	}
+	if hash := hex.EncodeToString(h.Sum(nil)); hash != self.DataSha1 {
+		err = errors.Info(errors.New("Invalid data sha1"), self.DataSha1, hash)
+	}
+	return
+}
+
+func (self *UpResume) Test() (msg string, err error) {
+
+	f, err := self.DataFile.Open()
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	log1, err := self.doTestInterrupt(f)
+	if err == nil {
+		msg += fmt.Sprintln(log1, " ok")
+		log1, err = self.doTestResume(f)
+	}
+	if err == nil {
+		msg += fmt.Sprintln(log1, " ok")
+		log1, err = self.doTestGet()
+	}
+	if err != nil {
+		msg += fmt.Sprintln(log1, err)
+		return
+	}
+	msg += fmt.Sprintln(log1, " ok")
+	return
+}
@@ -0,0 +1,214 @@
+package up
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"qbox.us/cc/config"
+	"qbox.us/errors"
+	"qbox.me/auth/digest"
+	"qbox.me/api"
+	"qbox.me/api/rs"
+	"qbox.me/api/upload"
+	"qbox.me/api/util"
+	"qbox.me/httputil"
+	"qbox.me/qetag"
+)
+
+// UpStream uploads a stream of unknown length, read from one of:
+//
+//	"data_file":    a data file or a generated payload, read sequentially
+//	"source_entry": the download of another entry of the env, "bucket:key"
+//	"source_url":   any url, e.g. of an object of another env
+//
+// then checks the entry made against the sha1 and qetag of what was read.
+type UpStream struct {
+	Name   string `json:"name"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+
+	DataFile    util.DataFile `json:"data_file"`
+	SourceEntry string        `json:"source_entry"`
+	SourceURL   string        `json:"source_url"`
+
+	MimeType      string `json:"mime_type"`
+	ChunkSize     int    `json:"chunk_size"`
+	BlockBits     uint   `json:"block_bits"`
+	InFlight      int    `json:"in_flight"` // blocks buffered and put at once, 2 if 0
+	PutRetryTimes int    `json:"put_retry_times"`
+	SendCrc32     bool   `json:"send_crc32"` // for the server to check each chunk
+
+	AdaptiveChunk *upload.ChunkPolicy `json:"adaptive_chunk"` // chunk_size is then the base size
+
+	size int64
+	sha1 string
+	etag string
+
+	Rscli *rs.Service
+	Upcli *upload.Service
+	Env   api.Env
+	rec   *httputil.Recorder
+}
+
+func (self *UpStream) Init(conf string, env *api.Env, path string) (err error) {
+
+	if err = config.LoadEx(self, conf); err != nil {
+		return
+	}
+	sources := 0
+	for _, set := range []bool{self.DataFile.Path != "" || self.DataFile.Gen != nil, self.SourceEntry != "", self.SourceURL != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New(self.Name + ": needs one of data_file, source_entry and source_url")
+	}
+	if self.InFlight <= 0 {
+		self.InFlight = 2
+	}
+	self.Env = *env
+	self.DataFile.Join(path)
+	self.rec = httputil.NewRecorder(self.Env.Transport())
+	dt := digest.NewTransport(self.Env.AccessKey, self.Env.SecretKey, self.Env.Retrying(self.rec))
+	if self.Rscli, err = rs.New(self.Env.Hosts, self.Env.URLs(), dt); err != nil {
+		return
+	}
+	self.Upcli = upload.New(self.Env.Hosts["up"], self.Env.URL("up"), self.BlockBits, self.ChunkSize, self.PutRetryTimes, dt)
+	self.Upcli.Backoff = self.Env.Retry
+	self.Upcli.SendCrc32 = self.SendCrc32
+	self.Upcli.Adaptive = self.AdaptiveChunk
+	return
+}
+
+func (self *UpStream) Services() []string {
+	return []string{"up", "rs", "io"}
+}
+
+// source opens what to upload, of size bytes, -1 if unknown.
+func (self *UpStream) source() (r io.ReadCloser, size int64, err error) {
+
+	url := self.SourceURL
+	if self.SourceEntry != "" {
+		ret, _, err := self.Rscli.Get(self.SourceEntry, "", "", 3600)
+		if err != nil {
+			return nil, 0, errors.Info(err, "get failed:", self.SourceEntry)
+		}
+		url = ret.URL
+	}
+	if url == "" {
+		f, err := self.DataFile.Open()
+		if err != nil {
+			return nil, 0, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, 0, f.Size()), f}, f.Size(), nil
+	}
+	resp, err := self.rec.Client().Get(url)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, errors.Info(errors.New("source download failed"), url, resp.StatusCode)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (self *UpStream) doTestStream() (msg string, err error) {
+
+	src, size, err := self.source()
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	entryURI := self.Bucket + ":" + self.Key
+	h1, h2 := sha1.New(), qetag.New()
+	t := self.Upcli.NewStreamTask(entryURI)
+	t.MimeType = self.MimeType
+
+	tr := self.Env.Progress.Start(self.Name+" "+entryURI, size)
+	defer tr.Done()
+
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestStream", self.rec)
+	code, err := t.RunStream(tr.Reader(io.TeeReader(src, io.MultiWriter(h1, h2))), self.InFlight, nil)
+	msg = step.Done()
+	msg += fmt.Sprintf("  %v bytes in %v blocks, %v, %v crc32 mismatches",
+		t.Size, len(t.Progress), t.ChunkStats(), t.Crc32Mismatches())
+	if err != nil {
+		err = errors.Info(err, "stream put failed:", entryURI, code)
+		return
+	}
+	self.size, self.sha1, self.etag = t.Size, hex.EncodeToString(h1.Sum(nil)), h2.Etag()
+	return
+}
+
+func (self *UpStream) doTestStat() (msg string, err error) {
+
+	entryURI := self.Bucket + ":" + self.Key
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestStat", self.rec)
+	entry, _, err := self.Rscli.Stat(entryURI)
+	msg = step.Done()
+	if err != nil {
+		err = errors.Info(err, "stat failed", entryURI)
+		return
+	}
+	if entry.Fsize != self.size {
+		err = errors.Info(errors.New("unexpected fsize"), entryURI, entry.Fsize, "streamed", self.size)
+		return
+	}
+	if entry.Hash != self.etag {
+		err = errors.Info(errors.New("hash differs from the qetag of the stream"), entry.Hash, self.etag)
+	}
+	return
+}
+
+func (self *UpStream) doTestGet() (msg string, err error) {
+
+	entryURI := self.Bucket + ":" + self.Key
+	step := util.NewStep("UP    "+self.Env.Id+"_"+self.Name+"_doTestGet", self.rec)
+	defer func() { msg = step.Done() }()
+	ret, _, err := self.Rscli.Get(entryURI, "", "", 3600)
+	if err != nil {
+		err = errors.Info(err, "get failed", entryURI)
+		return
+	}
+	resp, err := self.rec.Client().Get(ret.URL)
+	if err != nil {
+		err = errors.Info(err, "download failed", entryURI, ret.URL)
+		return
+	}
+	defer resp.Body.Close()
+	h := sha1.New()
+	if _, err = io.Copy(h, resp.Body); err != nil {
+		return
+	}
+	if hash := hex.EncodeToString(h.Sum(nil)); hash != self.sha1 {
+		err = errors.Info(errors.New("Invalid data sha1"), self.sha1, hash)
+	}
+	return
+}
+
+func (self *UpStream) Test() (msg string, err error) {
+
+	log1, err := self.doTestStream()
+	if err == nil {
+		msg += fmt.Sprintln(log1, " ok")
+		log1, err = self.doTestStat()
+	}
+	if err == nil {
+		msg += fmt.Sprintln(log1, " ok")
+		log1, err = self.doTestGet()
+	}
+	if err != nil {
+		msg += fmt.Sprintln(log1, err)
+		return
+	}
+	msg += fmt.Sprintln(log1, " ok")
+	return
+}
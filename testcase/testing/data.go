@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"qbox.me/api/util"
+	"qbox.us/errors"
+	"qbox.us/log"
+	"strings"
+)
+
+// dataCmd runs `qboxtestcase data verify|update`, which checks the data dir
+// against its manifest, or rewrites the manifest from the data dir.
+func dataCmd(dataPath string, args []string) int {
+
+	if len(args) != 1 || (args[0] != "verify" && args[0] != "update") {
+		fmt.Fprintln(os.Stderr, "usage: qboxtestcase [-f conf] data verify|update")
+		return 2
+	}
+	disk, err := util.ScanData(dataPath)
+	if err != nil {
+		log.Error("scan data err :", dataPath, err)
+		return 1
+	}
+	if args[0] == "update" {
+		if err = disk.Write(dataPath); err != nil {
+			log.Error("write manifest err :", dataPath, err)
+			return 1
+		}
+		fmt.Println(len(disk), "files in", dataPath+"/"+util.ManifestName)
+		return 0
+	}
+	if err = checkData(dataPath); err != nil {
+		fmt.Println(errors.Detail(err))
+		return 1
+	}
+	fmt.Println(len(disk), "files match", dataPath+"/"+util.ManifestName)
+	return 0
+}
+
+// checkData fails if a file of the manifest is missing or differs in the
+// data dir, and warns about the files not in the manifest: the cases using
+// them give their data_sha1 in their conf. A data dir without manifest is
+// not checked.
+func checkData(dataPath string) error {
+
+	m, err := util.LoadManifest(dataPath)
+	if os.IsNotExist(err) {
+		log.Warn("no data manifest in", dataPath)
+		return nil
+	}
+	if err != nil {
+		return errors.Info(err, "load data manifest", dataPath)
+	}
+	disk, err := util.ScanData(dataPath)
+	if err != nil {
+		return errors.Info(err, "scan data", dataPath)
+	}
+	diffs, unlisted := m.Diff(disk)
+	for _, path := range unlisted {
+		log.Warn("data not in the manifest :", path)
+	}
+	if len(diffs) > 0 {
+		return errors.Info(errors.New("data differs from its manifest, see `qboxtestcase data`:\n"+
+			strings.Join(diffs, "\n")), dataPath)
+	}
+	return nil
+}
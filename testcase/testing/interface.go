@@ -1,10 +1,13 @@
 package main
 
 import (
+	"qbox.me/api"
 	"./cases/example"
 	"./cases/fop"
 	"./cases/up"
+	"./cases/probe"
 	"./cases/pub"
+	"./cases/rs"
 )
 
 
@@ -12,16 +15,24 @@ var (
 	Cases = map[string]func () Interface{
 		"example": func() Interface { return &example.Example{} },
 		"resumable_put": func() Interface { return &up.UpResuPut{} },
+		"resumable_put2": func() Interface { return &up.UpRPut{} },
+		"up_resume": func() Interface { return &up.UpResume{} },
+		"up_stream": func() Interface { return &up.UpStream{} },
+		"up_form_callback": func() Interface { return &up.UpFormCallback{} },
 		"fop_img_info":  func() Interface { return &fop.FopImgInfo{} },
 		"fop_img_view":  func() Interface { return &fop.FopImgOp{} },
 		"fop_img_mogr":  func() Interface { return &fop.FopImgOp{} },
 		//"fop_img_exif":   &fop.FopImgExif{},
 		"up_put": func() Interface { return &up.PutFile{} },
 		//"old_mon":   &Old{},
-		//"rs":          &Rs{},
-		//"rs_upload":   &RsUpload{},
 		"publish": func() Interface { return &pub.Pub{} },
 		"pub_image": func() Interface { return &pub.PubImage{} },
+		"rs_list": func() Interface { return &rs.RsList{} },
+		"rs_batch": func() Interface { return &rs.RsBatch{} },
+		"rs_scenario": func() Interface { return &rs.RsScenario{} },
+		"rs_consistency": func() Interface { return &rs.RsConsistency{} },
+		"io_download": func() Interface { return &rs.IoDownload{} },
+		"http_probe": func() Interface { return &probe.HttpProbe{} },
 		"fop_img_exif" : func() Interface {return &fop.FopImgExif{}},
 		//"shell":       &Shell{},
 		//"up":          &Up{},
@@ -29,6 +40,6 @@ var (
 )
 
 type Interface interface {
-	Init(conf, env, path string) error
+	Init(conf string, env *api.Env, path string) error
 	Test() (msg string, err error)
 }
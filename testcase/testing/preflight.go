@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"qbox.me/api"
+	"qbox.us/errors"
+	"qbox.us/log"
+	"sync"
+	"time"
+)
+
+// A case implements ServiceUser to declare which env services ("up", "rs",
+// "io", "pu", "fopd", ...) it talks to. Cases which don't implement it are
+// never blocked by the pre-flight check.
+type ServiceUser interface {
+	Services() []string
+}
+
+type Probe struct {
+	Service string
+	Target  string
+	DNSOnly bool
+	Err     error
+}
+
+// probeTarget checks DNS, TCP connect and a plain GET against target, which
+// is either a host name or an url. Any HTTP response, whatever its status,
+// means the service is reachable.
+func probeTarget(target, host string, dnsOnly bool, timeout time.Duration) (err error) {
+
+	rawurl := target
+	if u, err1 := url.Parse(target); err1 != nil || u.Host == "" {
+		rawurl = "http://" + target
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return errors.Info(err, "preflight: bad url", target)
+	}
+	hostname, port := u.Host, "80"
+	if h, p, err1 := net.SplitHostPort(u.Host); err1 == nil {
+		hostname, port = h, p
+	} else if u.Scheme == "https" {
+		port = "443"
+	}
+
+	if net.ParseIP(hostname) == nil {
+		if _, err = net.LookupHost(hostname); err != nil {
+			return errors.Info(err, "preflight: dns", hostname)
+		}
+	}
+	if dnsOnly {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(hostname, port), timeout)
+	if err != nil {
+		return errors.Info(err, "preflight: connect", u.Host)
+	}
+	conn.Close()
+
+	req, err := http.NewRequest("GET", u.Scheme+"://"+u.Host+"/", nil)
+	if err != nil {
+		return errors.Info(err, "preflight: http", rawurl)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Info(err, "preflight: http", rawurl)
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	return nil
+}
+
+// Preflight probes every host and ip of env, plus fopd, concurrently. The
+// connections to a host are pinned to its ips (see api.Env.Transport), so
+// only its DNS is checked, the ips get the full probe.
+func Preflight(env *api.Env, timeout time.Duration) (probes []Probe) {
+
+	for svc, host := range env.Hosts {
+		probes = append(probes, Probe{Service: svc, Target: host, DNSOnly: true})
+	}
+	for svc, ips := range env.Ips {
+		for _, ip := range ips {
+			probes = append(probes, Probe{Service: svc, Target: ip})
+		}
+	}
+	if env.Fopd != "" {
+		probes = append(probes, Probe{Service: "fopd", Target: env.Fopd})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(probes))
+	for i := range probes {
+		go func(p *Probe) {
+			defer wg.Done()
+			p.Err = probeTarget(p.Target, env.Hosts[p.Service], p.DNSOnly, timeout)
+		}(&probes[i])
+	}
+	wg.Wait()
+
+	for _, p := range probes {
+		if p.Err == nil {
+			log.Info("preflight", p.Service, p.Target, "ok")
+		} else {
+			log.Warn("preflight", p.Service, p.Target, "failed:", errors.Detail(p.Err))
+		}
+	}
+	return
+}
+
+// blockedBy returns the first service needed by c which is unusable in
+// c.Env: fopd or its host failed the pre-flight, the host only mattering
+// for a service without ips, or all of its ips did.
+func blockedBy(c *Case, probes []Probe) (svc string, err error) {
+
+	user, ok := c.Interface.(ServiceUser)
+	if !ok {
+		return
+	}
+	for _, svc = range user.Services() {
+		var ipErr error
+		ips := 0
+		for _, p := range probes {
+			if p.Service != svc || p.Err == nil {
+				continue
+			}
+			if svc == "fopd" || (p.Target == c.Env.Hosts[svc] && len(c.Env.Ips[svc]) == 0) {
+				return svc, p.Err
+			}
+			for _, ip := range c.Env.Ips[svc] {
+				if p.Target == ip {
+					ipErr = p.Err
+					ips++
+				}
+			}
+		}
+		if ips > 0 && ips == len(c.Env.Ips[svc]) {
+			return svc, ipErr
+		}
+	}
+	return "", nil
+}
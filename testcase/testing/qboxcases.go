@@ -1,34 +1,68 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	filepath1 "path/filepath"
+	"qbox.me/api"
+	"qbox.me/api/progress"
+	"qbox.me/api/util"
+	"qbox.me/httputil"
 	"qbox.me/shell/shutil/filepath"
 	"qbox.us/cc"
 	"qbox.us/cc/config"
 	"qbox.us/errors"
 	"qbox.us/log"
 	"runtime"
+	"strconv"
+	"time"
 )
 
 type Config struct {
-	MaxProcs int    `json:"max_procs"`
-	DataPath string `json:"data"`
-	Include  string `json:"cases"`
-	Env      string `json:"env"`
+	MaxProcs   int      `json:"max_procs"`
+	DataPath   string   `json:"data"`
+	Include    string   `json:"cases"`
+	Env        string   `json:"env"`
+	Quarantine []string `json:"quarantine"` // known-bad cases, run but never alert
+
+	PreflightTimeout int `json:"preflight_timeout"` // s, 0 means 5s
+
+	// bandwidth of all the cases together, per second, e.g. "10MiB", none
+	// if empty; see CaseInfo.RateLimit
+	RateLimit string `json:"rate_limit"`
 }
 
 type Visitor struct {
 	*Config
-	cases map[string]Interface
+	envs  []api.Env
+	cases map[string]*Case
 }
 
 type CaseInfo struct {
-	Name   string `json:"name"`
-	Type   string `json:"type"`
-	Enable bool   `json:"enable"`
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Enable        bool   `json:"enable"`
+	Retries       int    `json:"retries"`
+	RetryInterval int    `json:"retry_interval"` // ms, doubled after each retry
+	Timeout       int    `json:"timeout"`        // s, 0 means no timeout
+	RateLimit     string `json:"rate_limit"`     // per second, under the global one
+}
+
+// newLimiter returns the limiter of rate, e.g. "2MiB" a second, under
+// parent, or parent if rate is empty.
+func newLimiter(rate string, parent *httputil.Limiter) (*httputil.Limiter, error) {
+	if rate == "" {
+		return parent, nil
+	}
+	n, err := util.ParseSize(rate)
+	if err != nil {
+		return nil, errors.Info(err, "bad rate_limit", rate)
+	}
+	return httputil.NewLimiter(n, parent), nil
 }
 
 func (p *Visitor) VisitDir(path string, fi os.FileInfo) bool { return true }
@@ -52,14 +86,30 @@ func (p *Visitor) VisitFile(file string, fi os.FileInfo) {
 			log.Error("no such type :", conf.Type, conf.Name)
 			os.Exit(1)
 		}
-		caseEntry := fun()
-		err := caseEntry.Init(file, p.Env, p.DataPath)
+		limiter, err := newLimiter(conf.RateLimit, httputil.DefaultLimiter)
 		if err != nil {
 			log.Error("init err :", conf.Name, conf.Type, err)
 			os.Exit(1)
 		}
-		p.cases[conf.Name] = caseEntry
-		log.Info("loaded", conf.Name, conf.Type)
+		// one instance per env variant, see api.Env.Variants, all sharing
+		// the limiter of the case
+		for i := range p.envs {
+			env := new(api.Env)
+			*env = p.envs[i]
+			env.Limiter = limiter
+			name := conf.Name
+			if len(p.envs) > 1 {
+				name += "@" + strconv.Itoa(i)
+			}
+			caseEntry := fun()
+			err := caseEntry.Init(file, env, p.DataPath)
+			if err != nil {
+				log.Error("init err :", name, conf.Type, err)
+				os.Exit(1)
+			}
+			p.cases[name] = &Case{caseEntry, conf, env}
+			log.Info("loaded", name, conf.Type)
+		}
 	}
 }
 
@@ -69,6 +119,8 @@ func main() {
 	)
 	confDir, _ := cc.GetConfigDir("qbox.me")
 	var confName *string = flag.String("f", confDir+"/qboxtest.conf", "the config file")
+	progressInterval := flag.Duration("progress", 30*time.Second, "how often to log the progress of long transfers, 0 for never")
+	metricsAddr := flag.String("metrics", "", "address to serve the expvar metrics on, e.g. :9100, none if empty")
 	flag.Parse()
 	log.Info("Use the config file of " + *confName)
 	if err := config.LoadEx(&conf, *confName); err != nil {
@@ -78,32 +130,96 @@ func main() {
 
 	runtime.GOMAXPROCS(conf.MaxProcs)
 
-	cases := make(map[string]Interface)
+	limiter, err := newLimiter(conf.RateLimit, nil)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	httputil.DefaultLimiter = limiter
+
+	cases := make(map[string]*Case)
 	conf.Include = filepath1.Join(confDir, conf.Include)
 	conf.DataPath = filepath1.Join(confDir, conf.DataPath)
 	conf.Env = filepath1.Join(confDir, conf.Env)
-	filepath.Walk(conf.Include, &Visitor{&conf, cases}, nil)
+
+	if flag.Arg(0) == "data" {
+		os.Exit(dataCmd(conf.DataPath, flag.Args()[1:]))
+	}
+	if err := checkData(conf.DataPath); err != nil {
+		log.Error(errors.Detail(err))
+		os.Exit(1)
+	}
+
+	var env api.Env
+	if err := config.LoadEx(&env, conf.Env); err != nil {
+		log.Error("load env err :", conf.Env, err)
+		os.Exit(1)
+	}
+	env.Progress = newProgress(*progressInterval, *metricsAddr)
+	envs := env.Variants()
+	for _, e := range envs[1:] {
+		log.Info("env variant", e.Id, e.Ips)
+	}
+	filepath.Walk(conf.Include, &Visitor{&conf, envs, cases}, nil)
+
+	preflightTimeout := 5 * time.Second
+	if conf.PreflightTimeout > 0 {
+		preflightTimeout = time.Duration(conf.PreflightTimeout) * time.Second
+	}
+	probes := Preflight(&env, preflightTimeout)
+
+	quarantined := make(map[string]bool)
+	for _, name := range conf.Quarantine {
+		quarantined[name] = true
+	}
 
 	check := func() bool {
 		msg := fmt.Sprintf("begin check ...\n")
 		errCount := 0
 		count := 0
+		stats := make([]int, len(statusNames))
+		// one alert per failed host or ip, however many cases it blocks
+		for _, p := range probes {
+			if p.Err != nil {
+				msg += fmt.Sprintf("!!!!!!!!!!mon env [%v %v] err!!![%v]\n", p.Service, p.Target, errors.Detail(p.Err))
+				errCount++
+			}
+		}
 		for k, v := range cases {
 			count++
 			log.Info("begin check", k, "...")
 			msg += fmt.Sprintf("[%v/%v]process %v <<<\n", count, len(cases), k)
-			info, err := v.Test()
-			log.Info("check done :\n", info, k, err)
-			msg += info
+			var res Result
+			if svc, err := blockedBy(v, probes); err != nil {
+				res = Result{Name: k, Status: Blocked, Err: errors.Info(err, "blocked by env", svc)}
+			} else {
+				res = runCase(k, v, quarantined[k])
+			}
+			log.Info("check done :\n", res.Msg, k, res.Status, res.Err)
+			msg += res.Msg
 			msg += "\n"
-			if err != nil {
-				msg += fmt.Sprintf("!!!!!!!!!!mon case [%v] err!!![%v]\n", k, errors.Detail(err))
+			stats[res.Status]++
+			switch {
+			case res.Failing():
+				msg += fmt.Sprintf("!!!!!!!!!!mon case [%v] %v(%v)!!![%v]\n", k, res.Status, res.Class, errors.Detail(res.Err))
 				errCount++
-			} else {
+			case res.Status == Failed || res.Status == TimedOut:
+				msg += fmt.Sprintf("[quarantined]%v %v: %v <<<\n", k, res.Status, errors.Detail(res.Err))
+			case res.Status == Blocked:
+				msg += fmt.Sprintf("[blocked]%v: %v <<<\n", k, errors.Detail(res.Err))
+			case res.Status == Skipped:
+				msg += fmt.Sprintf("[skipped]%v: %v <<<\n", k, errors.Detail(res.Err))
+			case res.Status == Flaky:
+				msg += fmt.Sprintf("[flaky]%v done after %v attempts <<<\n", k, res.Attempts)
+			default:
 				msg += fmt.Sprintf("[no err]%v done <<<\n", k)
 			}
 		}
-		msg += fmt.Sprintf("all cases finish[%v/%v] <<<\n", len(cases)-errCount, len(cases))
+		msg += fmt.Sprintf("all cases finish[%v/%v] <<<\n", stats[Passed]+stats[Flaky], len(cases))
+		for status, n := range stats {
+			msg += fmt.Sprintf("%v: %v  ", Status(status), n)
+		}
+		msg += "\n"
 		fmt.Println("----------------- result ------------------")
 		fmt.Println(msg)
 		fmt.Println("-------------------------------------------")
@@ -117,3 +233,23 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// newProgress returns the progress sink of the cases: a live line if
+// stderr is a terminal, a log line every interval, and, if metricsAddr is
+// set, the in-flight gauge published with expvar at /debug/vars.
+func newProgress(interval time.Duration, metricsAddr string) *progress.Sink {
+
+	var tty io.Writer
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		tty = os.Stderr
+	}
+	sink := progress.NewSink(tty, interval)
+	if metricsAddr != "" {
+		expvar.Publish("progress", expvar.Func(sink.Vars))
+		go func() {
+			log.Error("metrics server stopped:", http.ListenAndServe(metricsAddr, nil))
+		}()
+		log.Info("serving metrics on", metricsAddr+"/debug/vars")
+	}
+	return sink
+}
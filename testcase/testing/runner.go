@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"qbox.me/api"
+	"qbox.me/api/util"
+	"qbox.me/httputil"
+	"qbox.us/errors"
+	"qbox.us/log"
+	"time"
+)
+
+type Status int
+
+const (
+	Passed Status = iota
+	Failed
+	Skipped
+	TimedOut
+	Flaky   // passed, but only after a retry
+	Blocked // not run, a service it needs failed the pre-flight check
+)
+
+var statusNames = []string{
+	"passed",
+	"failed",
+	"skipped",
+	"timed-out",
+	"flaky",
+	"blocked by env",
+}
+
+func (s Status) String() string {
+	return statusNames[s]
+}
+
+type Case struct {
+	Interface
+	Info CaseInfo
+	Env  *api.Env
+}
+
+type Result struct {
+	Name        string
+	Status      Status
+	Attempts    int
+	Quarantined bool
+	Msg         string
+	Err         error
+	Class       string // errcode.Class* of Err
+}
+
+// Failing reports whether the result should be alerted on and counted
+// against the exit code.
+func (r *Result) Failing() bool {
+	if r.Quarantined {
+		return false
+	}
+	return r.Status == Failed || r.Status == TimedOut
+}
+
+// runOnce runs a single attempt of the case. A case which does not return
+// within timeout is reported as timed out and left running in background.
+func runOnce(c Interface, timeout time.Duration) (msg string, err error, timedOut bool) {
+
+	if timeout <= 0 {
+		msg, err = c.Test()
+		return
+	}
+
+	type ret struct {
+		msg string
+		err error
+	}
+	done := make(chan ret, 1)
+	go func() {
+		msg, err := c.Test()
+		done <- ret{msg, err}
+	}()
+	select {
+	case r := <-done:
+		return r.msg, r.err, false
+	case <-time.After(timeout):
+		return "", fmt.Errorf("timeout after %v", timeout), true
+	}
+}
+
+// runCase runs the case up to 1+retries times, doubling the retry interval
+// after each failed attempt. A timed out attempt is never retried because
+// it may still be running.
+func runCase(name string, c *Case, quarantined bool) (res Result) {
+
+	res = Result{Name: name, Quarantined: quarantined}
+	timeout := time.Duration(c.Info.Timeout) * time.Second
+	interval := time.Duration(c.Info.RetryInterval) * time.Millisecond
+	for {
+		res.Attempts++
+		msg, err, timedOut := runOnce(c, timeout)
+		res.Msg += msg
+		res.Err = err
+		res.Class = httputil.ClassOf(errors.Err(err))
+		switch {
+		case timedOut:
+			res.Status = TimedOut
+			return
+		case err == nil:
+			res.Status = Passed
+			if res.Attempts > 1 {
+				res.Status = Flaky
+			}
+			return
+		case errors.Err(err) == util.ErrSkipped:
+			res.Status = Skipped
+			return
+		}
+		res.Status = Failed
+		if res.Attempts > c.Info.Retries {
+			return
+		}
+		log.Warn("retry", name, "attempt", res.Attempts, "failed:", errors.Detail(err))
+		res.Msg += fmt.Sprintf("[retry %v/%v] %v\n", res.Attempts, c.Info.Retries, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}